@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"mime"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -21,18 +26,56 @@ import (
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/ryanuber/go-glob"
+	"github.com/sirupsen/logrus"
 )
 
+const (
+	// sseCustomer selects server-side encryption with a customer-provided key.
+	sseCustomer = "SSE-C"
+
+	// md5MetadataKey holds the content digest of objects whose ETag is not
+	// an MD5 digest.
+	md5MetadataKey = "s3sync-md5"
+)
+
+// object is a remote object as returned by List.
+type object struct {
+	key          string
+	size         int64
+	etag         string
+	lastModified *time.Time
+	storageClass s3types.ObjectStorageClass
+	recorded     *manifestEntry
+}
+
+func newObject(item s3types.Object) object {
+	return object{
+		key:          aws.ToString(item.Key),
+		size:         aws.ToInt64(item.Size),
+		etag:         aws.ToString(item.ETag),
+		lastModified: item.LastModified,
+		storageClass: item.StorageClass,
+	}
+}
+
+// archived reports whether the object has to be restored before it can be
+// read or copied.
+func (o *object) archived() bool {
+	return o.storageClass == s3types.ObjectStorageClassGlacier ||
+		o.storageClass == s3types.ObjectStorageClassDeepArchive
+}
+
 type AWS struct {
-	client   *s3.Client
-	cfClient *cloudfront.Client
-	remote   []string
-	local    []string
-	plugin   *Plugin
+	client            *s3.Client
+	cfClient          *cloudfront.Client
+	remote            []string
+	local             []string
+	plugin            *Plugin
+	sseCustomerKey    string
+	sseCustomerKeyMD5 string
 }
 
-func NewAWS(p *Plugin) AWS {
-	ctx := context.Background()
+func NewAWS(ctx context.Context, p *Plugin) (AWS, error) {
 
 	optFns := []func(*config.LoadOptions) error{
 		config.WithRegion(p.Region),
@@ -46,7 +89,7 @@ func NewAWS(p *Plugin) AWS {
 
 	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
 	if err != nil {
-		panic(fmt.Sprintf("unable to load AWS config: %v", err))
+		return AWS{}, fmt.Errorf("unable to load AWS config: %w", err)
 	}
 
 	s3Opts := []func(*s3.Options){}
@@ -70,7 +113,15 @@ func NewAWS(p *Plugin) AWS {
 	r := make([]string, 1)
 	l := make([]string, 1)
 
-	return AWS{c, cf, r, l, p}
+	a := AWS{client: c, cfClient: cf, remote: r, local: l, plugin: p}
+	if p.SSECustomerKey != "" {
+		key, _ := base64.StdEncoding.DecodeString(p.SSECustomerKey)
+		keyMD5 := md5.Sum(key)
+		a.sseCustomerKey = p.SSECustomerKey
+		a.sseCustomerKeyMD5 = base64.StdEncoding.EncodeToString(keyMD5[:])
+	}
+
+	return a, nil
 }
 
 func normalizeEndpoint(endpoint string) string {
@@ -80,20 +131,13 @@ func normalizeEndpoint(endpoint string) string {
 	return "https://" + endpoint
 }
 
-func (a *AWS) Upload(local, remote string) error {
-	ctx := context.Background()
+func (a *AWS) Upload(ctx context.Context, j job) (string, string, error) {
 	p := a.plugin
+	local, remote, listed, sums, info := j.local, j.remote, j.object, j.sums, j.info
 	if local == "" {
-		return nil
+		return outcomeSkipped, "", nil
 	}
 
-	file, err := os.Open(local)
-	if err != nil {
-		return err
-	}
-
-	defer file.Close()
-
 	var access string
 	for pattern := range p.Access {
 		if match := glob.Glob(pattern, local); match {
@@ -146,55 +190,37 @@ func (a *AWS) Upload(local, remote string) error {
 		}
 	}
 
-	head, err := a.client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(p.Bucket),
-		Key:    aws.String(remote),
-	})
-	if err != nil {
-		var apiErr smithy.APIError
-		isNotFound := false
-		if ok := errors.As(err, &apiErr); ok {
-			if apiErr.ErrorCode() == "404" || apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
-				isNotFound = true
-			}
-		}
-		var nsb *s3types.NoSuchKey
-		if errors.As(err, &nsb) {
-			isNotFound = true
-		}
-
-		if !isNotFound {
-			debug("\"%s\" not found in bucket, uploading with Content-Type \"%s\" and permissions \"%s\"", local, contentType, access)
-			var putObject = &s3.PutObjectInput{
-				Bucket:      aws.String(p.Bucket),
-				Key:         aws.String(remote),
-				Body:        file,
-				ContentType: aws.String(contentType),
-				ACL:         s3types.ObjectCannedACL(access),
-				Metadata:    metadata,
-			}
-
-			if len(cacheControl) > 0 {
-				putObject.CacheControl = aws.String(cacheControl)
-			}
+	sse, kmsKeyID := p.encryption(local)
 
-			if len(contentEncoding) > 0 {
-				putObject.ContentEncoding = aws.String(contentEncoding)
-			}
+	for k, v := range compareMetadata(p.Compare, sse, sums, info) {
+		metadata[k] = v
+	}
 
-			if a.plugin.DryRun {
-				return nil
+	entry := manifestEntryFor(sums, info.Size(), info.ModTime().Unix())
+	entry.ContentType = contentType
+	entry.ContentEncoding = contentEncoding
+	entry.CacheControl = cacheControl
+	entry.Metadata = metadata
+	entry.ACL = access
+	entry.SSE = sse
+	entry.SSEKMSKeyID = kmsKeyID
+	entry.Commit = p.Commit
+
+	put := func(outcome, reason string) (string, string, error) {
+		var body io.ReadSeeker = bytes.NewReader(j.body)
+		if j.body == nil {
+			file, err := os.Open(local)
+			if err != nil {
+				return "", "", err
 			}
-
-			_, err = a.client.PutObject(ctx, putObject)
-			return err
+			defer file.Close()
+			body = file
 		}
 
-		debug("\"%s\" not found in bucket, uploading with Content-Type \"%s\" and permissions \"%s\"", local, contentType, access)
 		var putObject = &s3.PutObjectInput{
 			Bucket:      aws.String(p.Bucket),
 			Key:         aws.String(remote),
-			Body:        file,
+			Body:        body,
 			ContentType: aws.String(contentType),
 			ACL:         s3types.ObjectCannedACL(access),
 			Metadata:    metadata,
@@ -208,76 +234,191 @@ func (a *AWS) Upload(local, remote string) error {
 			putObject.ContentEncoding = aws.String(contentEncoding)
 		}
 
+		a.encryptPut(putObject, sse, kmsKeyID)
+
+		if p.Compare == compareChecksum {
+			putObject.ChecksumAlgorithm = s3types.ChecksumAlgorithmSha256
+			putObject.ChecksumSHA256 = aws.String(sums.checksum())
+		}
+
 		if a.plugin.DryRun {
-			return nil
+			return outcome, reason, nil
 		}
 
-		_, err = a.client.PutObject(ctx, putObject)
-		return err
+		_, err := a.client.PutObject(ctx, putObject)
+		if err == nil {
+			p.manifest.record(remote, entry)
+		}
+		return outcome, reason, err
 	}
 
-	hash := md5.New()
-	_, _ = io.Copy(hash, file)
-	sum := fmt.Sprintf("\"%x\"", hash.Sum(nil))
+	// update replaces the headers of an object whose content is current.
+	update := func(previousSSE, reason string) (string, string, error) {
+		// Archived objects cannot be copied in place, so their metadata is
+		// updated by uploading them again.
+		if listed.archived() {
+			return put(outcomeMetadata, reason+", object is archived")
+		}
 
-	if head.ETag != nil && sum == *head.ETag {
-		shouldCopy := false
+		var copyObject = &s3.CopyObjectInput{
+			Bucket:            aws.String(p.Bucket),
+			Key:               aws.String(remote),
+			CopySource:        aws.String(fmt.Sprintf("%s/%s", p.Bucket, remote)),
+			ACL:               s3types.ObjectCannedACL(access),
+			ContentType:       aws.String(contentType),
+			Metadata:          metadata,
+			MetadataDirective: s3types.MetadataDirectiveReplace,
+		}
 
-		if head.ContentType == nil && contentType != "" {
-			debug("Content-Type has changed from unset to %s", contentType)
-			shouldCopy = true
+		if len(cacheControl) > 0 {
+			copyObject.CacheControl = aws.String(cacheControl)
 		}
 
-		if !shouldCopy && head.ContentType != nil && contentType != *head.ContentType {
-			debug("Content-Type has changed from %s to %s", *head.ContentType, contentType)
-			shouldCopy = true
+		if len(contentEncoding) > 0 {
+			copyObject.ContentEncoding = aws.String(contentEncoding)
 		}
 
-		if !shouldCopy && head.ContentEncoding == nil && contentEncoding != "" {
-			debug("Content-Encoding has changed from unset to %s", contentEncoding)
-			shouldCopy = true
+		a.encryptCopy(copyObject, sse, kmsKeyID, previousSSE)
+
+		if p.Compare == compareChecksum {
+			copyObject.ChecksumAlgorithm = s3types.ChecksumAlgorithmSha256
 		}
 
-		if !shouldCopy && head.ContentEncoding != nil && contentEncoding != *head.ContentEncoding {
-			debug("Content-Encoding has changed from %s to %s", *head.ContentEncoding, contentEncoding)
-			shouldCopy = true
+		if a.plugin.DryRun {
+			return outcomeMetadata, reason, nil
 		}
 
-		if !shouldCopy && head.CacheControl == nil && cacheControl != "" {
-			debug("Cache-Control has changed from unset to %s", cacheControl)
-			shouldCopy = true
+		_, err := a.client.CopyObject(ctx, copyObject)
+		if err == nil {
+			p.manifest.record(remote, entry)
 		}
+		return outcomeMetadata, reason, err
+	}
+
+	if listed == nil {
+		return put(outcomeCreated, "not found in bucket")
+	}
 
-		if !shouldCopy && head.CacheControl != nil && cacheControl != *head.CacheControl {
-			debug("Cache-Control has changed from %s to %s", *head.CacheControl, cacheControl)
-			shouldCopy = true
+	// Objects recorded in the manifest are compared without any request.
+	if listed.recorded != nil {
+		content, headers := listed.recorded.matches(entry, p.Compare)
+		if content && headers {
+			p.manifest.record(remote, *listed.recorded)
+			return outcomeSkipped, "matches the manifest", nil
 		}
+		if content {
+			return update(listed.recorded.SSE, "headers differ from the manifest")
+		}
+
+		return put(outcomeUpdated, "content differs from the manifest")
+	}
 
-		if !shouldCopy && len(head.Metadata) != len(metadata) {
-			debug("Count of metadata values has changed for %s", local)
-			shouldCopy = true
+	// The listing carries the ETag and size of the object, which often
+	// settles the comparison without requesting the object headers.
+	matched := listedContentMatches(p.Compare, listed, sums, info)
+	if !matched && p.Compare == compareETag && etagIsMD5(sse) {
+		return put(outcomeUpdated, "ETag has changed")
+	}
+
+	var head *s3.HeadObjectOutput
+	var err error
+	if !matched || p.comparesHeaders() {
+		headObject := &s3.HeadObjectInput{
+			Bucket: aws.String(p.Bucket),
+			Key:    aws.String(remote),
+		}
+		if sse == sseCustomer {
+			headObject.SSECustomerAlgorithm = aws.String(string(s3types.ServerSideEncryptionAes256))
+			headObject.SSECustomerKey = aws.String(a.sseCustomerKey)
+			headObject.SSECustomerKeyMD5 = aws.String(a.sseCustomerKeyMD5)
 		}
+		if p.Compare == compareChecksum {
+			headObject.ChecksumMode = s3types.ChecksumModeEnabled
+		}
+
+		head, err = a.client.HeadObject(ctx, headObject)
+		if err != nil {
+			var apiErr smithy.APIError
+			isNotFound := false
+			if ok := errors.As(err, &apiErr); ok {
+				if apiErr.ErrorCode() == "404" || apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+					isNotFound = true
+				}
+			}
+			var nsb *s3types.NoSuchKey
+			if errors.As(err, &nsb) {
+				isNotFound = true
+			}
+
+			if !isNotFound {
+				return put(outcomeUpdated, fmt.Sprintf("unable to retrieve headers: %v", err))
+			}
+
+			return put(outcomeCreated, "not found in bucket")
+		}
+
+		matched = matched || contentMatches(p.Compare, head, sums, info)
+	}
+
+	if matched {
+		var reason string
+
+		if p.comparesHeaders() {
+			if head.ContentType == nil && contentType != "" {
+				reason = fmt.Sprintf("Content-Type has changed from unset to %s", contentType)
+			}
 
-		if !shouldCopy && len(metadata) > 0 {
-			for k, v := range metadata {
-				if hv, ok := head.Metadata[k]; ok {
-					if v != hv {
-						debug("Metadata values have changed for %s", local)
-						shouldCopy = true
-						break
+			if reason == "" && head.ContentType != nil && contentType != *head.ContentType {
+				reason = fmt.Sprintf("Content-Type has changed from %s to %s", *head.ContentType, contentType)
+			}
+
+			if reason == "" && head.ContentEncoding == nil && contentEncoding != "" {
+				reason = fmt.Sprintf("Content-Encoding has changed from unset to %s", contentEncoding)
+			}
+
+			if reason == "" && head.ContentEncoding != nil && contentEncoding != *head.ContentEncoding {
+				reason = fmt.Sprintf("Content-Encoding has changed from %s to %s", *head.ContentEncoding, contentEncoding)
+			}
+
+			if reason == "" && head.CacheControl == nil && cacheControl != "" {
+				reason = fmt.Sprintf("Cache-Control has changed from unset to %s", cacheControl)
+			}
+
+			if reason == "" && head.CacheControl != nil && cacheControl != *head.CacheControl {
+				reason = fmt.Sprintf("Cache-Control has changed from %s to %s", *head.CacheControl, cacheControl)
+			}
+
+			if reason == "" && len(head.Metadata) != len(metadata) {
+				reason = "count of metadata values has changed"
+			}
+
+			if reason == "" && len(metadata) > 0 {
+				for k, v := range metadata {
+					if hv, ok := head.Metadata[k]; ok {
+						if v != hv {
+							reason = "metadata values have changed"
+							break
+						}
 					}
 				}
 			}
+
+			if reason == "" && sse != "" && sse != headEncryption(head) {
+				reason = fmt.Sprintf("encryption has changed from \"%s\" to \"%s\"", headEncryption(head), sse)
+			}
+
+			if reason == "" && kmsKeyID != "" && !kmsKeyAlias(kmsKeyID) && !strings.HasSuffix(aws.ToString(head.SSEKMSKeyId), kmsKeyID) {
+				reason = fmt.Sprintf("KMS key has changed from \"%s\" to \"%s\"", aws.ToString(head.SSEKMSKeyId), kmsKeyID)
+			}
 		}
 
-		if !shouldCopy {
-			debug("Retrieving ACL for \"%s\"", local)
+		if reason == "" && len(p.Access) > 0 {
 			grant, err := a.client.GetObjectAcl(ctx, &s3.GetObjectAclInput{
 				Bucket: aws.String(p.Bucket),
 				Key:    aws.String(remote),
 			})
 			if err != nil {
-				return err
+				return "", "", err
 			}
 
 			previousAccess := "private"
@@ -295,96 +436,165 @@ func (a *AWS) Upload(local, remote string) error {
 			}
 
 			if previousAccess != access {
-				debug("Permissions for \"%s\" have changed from \"%s\" to \"%s\"", remote, previousAccess, access)
-				shouldCopy = true
+				reason = fmt.Sprintf("permissions have changed from \"%s\" to \"%s\"", previousAccess, access)
 			}
 		}
 
-		if !shouldCopy {
-			debug("Skipping \"%s\" because hashes and metadata match", local)
-			return nil
+		if reason == "" {
+			p.manifest.record(remote, entry)
+			return outcomeSkipped, "content and metadata match", nil
 		}
 
-		debug("Updating metadata for \"%s\" Content-Type: \"%s\", ACL: \"%s\"", local, contentType, access)
-		var copyObject = &s3.CopyObjectInput{
-			Bucket:            aws.String(p.Bucket),
-			Key:               aws.String(remote),
-			CopySource:        aws.String(fmt.Sprintf("%s/%s", p.Bucket, remote)),
-			ACL:               s3types.ObjectCannedACL(access),
-			ContentType:       aws.String(contentType),
-			Metadata:          metadata,
-			MetadataDirective: s3types.MetadataDirectiveReplace,
-		}
+		return update(headEncryption(head), reason)
+	}
 
-		if len(cacheControl) > 0 {
-			copyObject.CacheControl = aws.String(cacheControl)
-		}
+	return put(outcomeUpdated, "content has changed")
+}
 
-		if len(contentEncoding) > 0 {
-			copyObject.ContentEncoding = aws.String(contentEncoding)
-		}
+// encryptPut sets the server-side encryption headers for an upload.
+func (a *AWS) encryptPut(in *s3.PutObjectInput, sse, kmsKeyID string) {
+	switch sse {
+	case "":
+		return
+	case sseCustomer:
+		in.SSECustomerAlgorithm = aws.String(string(s3types.ServerSideEncryptionAes256))
+		in.SSECustomerKey = aws.String(a.sseCustomerKey)
+		in.SSECustomerKeyMD5 = aws.String(a.sseCustomerKeyMD5)
+		return
+	}
 
-		if a.plugin.DryRun {
-			return nil
+	in.ServerSideEncryption = s3types.ServerSideEncryption(sse)
+	if sse != string(s3types.ServerSideEncryptionAes256) {
+		if kmsKeyID != "" {
+			in.SSEKMSKeyId = aws.String(kmsKeyID)
 		}
-
-		_, err = a.client.CopyObject(ctx, copyObject)
-		return err
-	} else {
-		_, err = file.Seek(0, 0)
-		if err != nil {
-			return err
+		if a.plugin.SSEBucketKey {
+			in.BucketKeyEnabled = aws.Bool(true)
 		}
+	}
+}
 
-		debug("Uploading \"%s\" with Content-Type \"%s\" and permissions \"%s\"", local, contentType, access)
-		var putObject = &s3.PutObjectInput{
-			Bucket:      aws.String(p.Bucket),
-			Key:         aws.String(remote),
-			Body:        file,
-			ContentType: aws.String(contentType),
-			ACL:         s3types.ObjectCannedACL(access),
-			Metadata:    metadata,
+// encryption returns the encryption rules matching path.
+func (p *Plugin) encryption(path string) (sse, kmsKeyID string) {
+	for pattern := range p.SSE {
+		if match := glob.Glob(pattern, path); match {
+			sse = p.SSE[pattern]
+			break
 		}
+	}
 
-		if len(cacheControl) > 0 {
-			putObject.CacheControl = aws.String(cacheControl)
+	for pattern := range p.SSEKMSKeyID {
+		if match := glob.Glob(pattern, path); match {
+			kmsKeyID = p.SSEKMSKeyID[pattern]
+			break
 		}
+	}
+	return sse, kmsKeyID
+}
 
-		if len(contentEncoding) > 0 {
-			putObject.ContentEncoding = aws.String(contentEncoding)
-		}
+// objectEncryption returns the encryption rules of an object written by the
+// plugin itself, like the manifest. Without a rule matching its key the
+// first rule is used, so buckets denying unencrypted uploads accept it.
+func (p *Plugin) objectEncryption(key string) (sse, kmsKeyID string) {
+	sse, kmsKeyID = p.encryption(key)
+	if sse == "" && len(p.SSE) > 0 {
+		sse = p.SSE[slices.Min(slices.Collect(maps.Keys(p.SSE)))]
+	}
+	if kmsKeyID == "" && len(p.SSEKMSKeyID) > 0 {
+		kmsKeyID = p.SSEKMSKeyID[slices.Min(slices.Collect(maps.Keys(p.SSEKMSKeyID)))]
+	}
+	return sse, kmsKeyID
+}
 
-		if a.plugin.DryRun {
-			return nil
+// encryptCopy sets the server-side encryption headers for an in-place copy.
+// Objects stored with SSE-C can only be read back by passing the same key as
+// the copy source key.
+func (a *AWS) encryptCopy(in *s3.CopyObjectInput, sse, kmsKeyID, previous string) {
+	if previous == sseCustomer {
+		in.CopySourceSSECustomerAlgorithm = aws.String(string(s3types.ServerSideEncryptionAes256))
+		in.CopySourceSSECustomerKey = aws.String(a.sseCustomerKey)
+		in.CopySourceSSECustomerKeyMD5 = aws.String(a.sseCustomerKeyMD5)
+	}
+
+	switch sse {
+	case "":
+		return
+	case sseCustomer:
+		in.SSECustomerAlgorithm = aws.String(string(s3types.ServerSideEncryptionAes256))
+		in.SSECustomerKey = aws.String(a.sseCustomerKey)
+		in.SSECustomerKeyMD5 = aws.String(a.sseCustomerKeyMD5)
+		return
+	}
+
+	in.ServerSideEncryption = s3types.ServerSideEncryption(sse)
+	if sse != string(s3types.ServerSideEncryptionAes256) {
+		if kmsKeyID != "" {
+			in.SSEKMSKeyId = aws.String(kmsKeyID)
+		}
+		if a.plugin.SSEBucketKey {
+			in.BucketKeyEnabled = aws.Bool(true)
 		}
+	}
+}
 
-		_, err = a.client.PutObject(ctx, putObject)
-		return err
+// kmsKeyAlias reports whether a KMS key is given by an alias. Objects only
+// carry the ARN of their key, so aliases cannot be compared with them.
+func kmsKeyAlias(kmsKeyID string) bool {
+	return strings.HasPrefix(kmsKeyID, "alias/") || strings.Contains(kmsKeyID, ":alias/")
+}
+
+// headEncryption returns the encryption mode of an existing object using the
+// same values as the sse option.
+func headEncryption(head *s3.HeadObjectOutput) string {
+	if head == nil {
+		return ""
+	}
+	if head.SSECustomerAlgorithm != nil {
+		return sseCustomer
 	}
+	return string(head.ServerSideEncryption)
 }
 
-func (a *AWS) Redirect(path, location string) error {
-	ctx := context.Background()
+// etagIsMD5 reports whether objects stored with the given encryption mode
+// have the MD5 digest of their content as ETag.
+func etagIsMD5(sse string) bool {
+	return sse == "" || sse == string(s3types.ServerSideEncryptionAes256)
+}
+
+func (a *AWS) Redirect(ctx context.Context, path, location string) error {
 	p := a.plugin
-	debug("Adding redirect from \"%s\" to \"%s\"", path, location)
+	logrus.WithFields(logrus.Fields{"key": path, "location": location}).Debug("adding redirect")
 
 	if a.plugin.DryRun {
 		return nil
 	}
 
-	_, err := a.client.PutObject(ctx, &s3.PutObjectInput{
+	putObject := &s3.PutObjectInput{
 		Bucket:                  aws.String(p.Bucket),
 		Key:                     aws.String(path),
 		ACL:                     s3types.ObjectCannedACLPublicRead,
 		WebsiteRedirectLocation: aws.String(location),
-	})
+	}
+	sse, kmsKeyID := p.encryption(path)
+	a.encryptPut(putObject, sse, kmsKeyID)
+
+	_, err := a.client.PutObject(ctx, putObject)
+	// Redirects configured outside the target are not part of its manifest.
+	if err == nil && strings.HasPrefix(path, targetPrefix(p.Target)) {
+		p.manifest.record(path, manifestEntry{
+			ACL:         string(s3types.ObjectCannedACLPublicRead),
+			Redirect:    location,
+			SSE:         sse,
+			SSEKMSKeyID: kmsKeyID,
+			Commit:      p.Commit,
+		})
+	}
 	return err
 }
 
-func (a *AWS) Delete(remote string) error {
-	ctx := context.Background()
+func (a *AWS) Delete(ctx context.Context, remote string) error {
 	p := a.plugin
-	debug("Removing remote file \"%s\"", remote)
+	logrus.WithField("key", remote).Debug("removing remote file")
 
 	if a.plugin.DryRun {
 		return nil
@@ -394,59 +604,142 @@ func (a *AWS) Delete(remote string) error {
 		Bucket: aws.String(p.Bucket),
 		Key:    aws.String(remote),
 	})
+	if err == nil {
+		p.manifest.remove(remote)
+	}
 	return err
 }
 
-func (a *AWS) List(path string) ([]string, error) {
-	ctx := context.Background()
+func (a *AWS) List(ctx context.Context, path string) ([]object, error) {
 	p := a.plugin
-	remote := make([]string, 1)
-	resp, err := a.client.ListObjects(ctx, &s3.ListObjectsInput{
+	remote := []object{}
+	paginator := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(p.Bucket),
-		Prefix: aws.String(path),
+		Prefix: aws.String(targetPrefix(path)),
 	})
-	if err != nil {
-		return remote, err
-	}
-
-	for _, item := range resp.Contents {
-		remote = append(remote, *item.Key)
-	}
-
-	for aws.ToBool(resp.IsTruncated) {
-		resp, err = a.client.ListObjects(ctx, &s3.ListObjectsInput{
-			Bucket: aws.String(p.Bucket),
-			Prefix: aws.String(path),
-			Marker: aws.String(remote[len(remote)-1]),
-		})
 
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
 		if err != nil {
 			return remote, err
 		}
 
 		for _, item := range resp.Contents {
-			remote = append(remote, *item.Key)
+			remote = append(remote, newObject(item))
 		}
 	}
 
 	return remote, nil
 }
 
-func (a *AWS) Invalidate(invalidatePath string) error {
-	ctx := context.Background()
+// ReadManifest retrieves the manifest written by a previous run.
+func (a *AWS) ReadManifest(ctx context.Context, key string) (*manifest, error) {
+	m := &manifest{}
+	if err := a.getJSON(ctx, key, m); err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteManifest stores the manifest for the next run.
+func (a *AWS) WriteManifest(ctx context.Context, key string, m *manifest) error {
+	logrus.WithField("key", key).Debug("writing manifest")
+
+	if a.plugin.DryRun {
+		return nil
+	}
+
+	m.mu.Lock()
+	data, err := json.Marshal(m)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return a.putJSON(ctx, key, data)
+}
+
+// ReadPreviewMarker reads the marker of a preview.
+func (a *AWS) ReadPreviewMarker(ctx context.Context, key string) (*previewMarker, error) {
+	m := &previewMarker{}
+	if err := a.getJSON(ctx, key, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WritePreviewMarker stores the marker of a preview deployed by this run.
+func (a *AWS) WritePreviewMarker(ctx context.Context, key string, m previewMarker) error {
+	logrus.WithField("key", key).Debug("writing preview marker")
+
+	if a.plugin.DryRun {
+		return nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return a.putJSON(ctx, key, data)
+}
+
+// getJSON decodes the JSON object stored at key into v.
+func (a *AWS) getJSON(ctx context.Context, key string, v any) error {
+	getObject := &s3.GetObjectInput{
+		Bucket: aws.String(a.plugin.Bucket),
+		Key:    aws.String(key),
+	}
+	if sse, _ := a.plugin.objectEncryption(key); sse == sseCustomer {
+		getObject.SSECustomerAlgorithm = aws.String(string(s3types.ServerSideEncryptionAes256))
+		getObject.SSECustomerKey = aws.String(a.sseCustomerKey)
+		getObject.SSECustomerKeyMD5 = aws.String(a.sseCustomerKeyMD5)
+	}
+
+	resp, err := a.client.GetObject(ctx, getObject)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// putJSON stores a private JSON object at key.
+func (a *AWS) putJSON(ctx context.Context, key string, data []byte) error {
+	putObject := &s3.PutObjectInput{
+		Bucket:      aws.String(a.plugin.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+		ACL:         s3types.ObjectCannedACLPrivate,
+	}
+	sse, kmsKeyID := a.plugin.objectEncryption(key)
+	a.encryptPut(putObject, sse, kmsKeyID)
+
+	_, err := a.client.PutObject(ctx, putObject)
+	return err
+}
+
+// Invalidate creates an invalidation and returns its id.
+func (a *AWS) Invalidate(ctx context.Context, paths []string) (string, error) {
 	p := a.plugin
-	debug("Invalidating \"%s\"", invalidatePath)
-	_, err := a.cfClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+	logrus.WithFields(logrus.Fields{"distribution": p.CloudFrontDistribution, "paths": paths}).Info("invalidating")
+	resp, err := a.cfClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
 		DistributionId: aws.String(p.CloudFrontDistribution),
 		InvalidationBatch: &cftypes.InvalidationBatch{
 			CallerReference: aws.String(time.Now().Format(time.RFC3339Nano)),
 			Paths: &cftypes.Paths{
-				Quantity: aws.Int32(1),
-				Items: []string{
-					invalidatePath,
-				},
+				Quantity: aws.Int32(int32(len(paths))),
+				Items:    paths,
 			},
 		},
 	})
-	return err
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(resp.Invalidation.Id), nil
 }
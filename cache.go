@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const hashCacheVersion = 1
+
+// hashCache remembers the digests of local files between runs, so files that
+// have not been modified since are not read again. Files are keyed by their
+// absolute path, as the sources of several mappings share the cache.
+type hashCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]hashCacheEntry
+	seen    map[string]hashCacheEntry
+}
+
+type hashCacheEntry struct {
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"`
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type hashCacheFile struct {
+	Version int                       `json:"version"`
+	Entries map[string]hashCacheEntry `json:"entries"`
+}
+
+// loadHashCache reads the cache file at path. A missing or unreadable cache
+// file results in an empty cache.
+func loadHashCache(path string) *hashCache {
+	c := &hashCache{
+		path:    path,
+		entries: map[string]hashCacheEntry{},
+		seen:    map[string]hashCacheEntry{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("path", path).Warn("ignoring hash cache")
+		}
+		return c
+	}
+
+	var f hashCacheFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Version != hashCacheVersion {
+		logrus.WithField("path", path).Warn("ignoring invalid hash cache")
+		return c
+	}
+	if f.Entries != nil {
+		c.entries = f.Entries
+	}
+
+	return c
+}
+
+// digests returns the digests of the file needed by the compare strategy,
+// reusing cached values when the size and modification time are unchanged.
+// The content of the file is returned as well when it had to be read and is
+// no larger than buffer.
+func (c *hashCache) digests(key string, file *os.File, info os.FileInfo, compare string, buffer int64) (digests, []byte, error) {
+	if c == nil || compare == compareSizeMtime {
+		return hashFile(file, info.Size(), compare, buffer)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if !ok || entry.Size != info.Size() || entry.Mtime != info.ModTime().UnixNano() {
+		entry = hashCacheEntry{Size: info.Size(), Mtime: info.ModTime().UnixNano()}
+	}
+
+	var d digests
+	var body []byte
+	var err error
+	switch {
+	case compare == compareETag && entry.MD5 != "":
+		d.md5, err = hex.DecodeString(entry.MD5)
+	case compare != compareETag && entry.SHA256 != "":
+		d.sha256, err = hex.DecodeString(entry.SHA256)
+	default:
+		d, body, err = hashFile(file, info.Size(), compare, buffer)
+	}
+	if err != nil {
+		return d, nil, err
+	}
+
+	if d.md5 != nil {
+		entry.MD5 = hex.EncodeToString(d.md5)
+	}
+	if d.sha256 != nil {
+		entry.SHA256 = hex.EncodeToString(d.sha256)
+	}
+
+	c.mu.Lock()
+	c.seen[key] = entry
+	c.mu.Unlock()
+
+	return d, body, nil
+}
+
+// save writes the entries of the files seen during this run, dropping files
+// that no longer exist.
+func (c *hashCache) save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	data, err := json.Marshal(hashCacheFile{
+		Version: hashCacheVersion,
+		Entries: c.seen,
+	})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
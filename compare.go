@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Strategies used to decide whether a local file matches the remote object.
+const (
+	// compareETag compares the MD5 digest of the file with the object ETag,
+	// falling back to a digest stored as metadata for encrypted objects.
+	compareETag = "etag"
+
+	// compareSHA256 compares the SHA-256 digest of the file with a digest
+	// stored as object metadata at upload time.
+	compareSHA256 = "sha256"
+
+	// compareChecksum uploads objects with an S3 additional checksum and
+	// compares it using the checksum mode of HeadObject.
+	compareChecksum = "checksum"
+
+	// compareSizeMtime compares the size of the file and treats the object as
+	// current when it was modified after the local file.
+	compareSizeMtime = "size-mtime"
+)
+
+const (
+	sha256MetadataKey = "s3sync-sha256"
+	mtimeMetadataKey  = "s3sync-mtime"
+)
+
+var compareModes = map[string]bool{
+	compareETag:      true,
+	compareSHA256:    true,
+	compareChecksum:  true,
+	compareSizeMtime: true,
+}
+
+type digests struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// etag returns the MD5 digest formatted like an S3 ETag.
+func (d digests) etag() string {
+	return fmt.Sprintf("\"%x\"", d.md5)
+}
+
+// checksum returns the SHA-256 digest formatted like an S3 additional checksum.
+func (d digests) checksum() string {
+	return base64.StdEncoding.EncodeToString(d.sha256)
+}
+
+// Files are kept in memory once hashed up to maxBufferSize, so they are
+// uploaded without being read again. Larger files are read a second time for
+// the upload, as the digest decides whether they are uploaded at all and is
+// sent in the headers ahead of the content. The files kept in memory at the
+// same time share bufferBudget, which at the default max-concurrency keeps
+// files up to about 320 KiB.
+const (
+	maxBufferSize = 1 << 20
+	bufferBudget  = 64 << 20
+)
+
+// hashFile computes the digests needed by the compare strategy in a single
+// read. The content of files up to buffer bytes is returned for the upload.
+func hashFile(file *os.File, size int64, compare string, buffer int64) (digests, []byte, error) {
+	var d digests
+	if compare == compareSizeMtime {
+		return d, nil, nil
+	}
+
+	var h hash.Hash = md5.New()
+	if compare != compareETag {
+		h = sha256.New()
+	}
+
+	var body []byte
+	var err error
+	if size <= buffer {
+		body, err = io.ReadAll(file)
+		h.Write(body)
+	} else {
+		_, err = io.Copy(h, file)
+	}
+	if err != nil {
+		return d, nil, err
+	}
+
+	if compare == compareETag {
+		d.md5 = h.Sum(nil)
+	} else {
+		d.sha256 = h.Sum(nil)
+	}
+	return d, body, nil
+}
+
+// compareMetadata returns the metadata stored alongside an upload so the
+// content can be compared on the next run.
+func compareMetadata(compare, sse string, d digests, info os.FileInfo) map[string]string {
+	switch {
+	case compare == compareETag && !etagIsMD5(sse):
+		return map[string]string{md5MetadataKey: hex.EncodeToString(d.md5)}
+	case compare == compareSHA256:
+		return map[string]string{sha256MetadataKey: hex.EncodeToString(d.sha256)}
+	case compare == compareSizeMtime:
+		return map[string]string{mtimeMetadataKey: strconv.FormatInt(info.ModTime().Unix(), 10)}
+	}
+	return nil
+}
+
+// sizeMtimeMatches reports whether a listed object is current for the local
+// file, which is the case when the size is equal and the object was written
+// after the file was last modified.
+func sizeMtimeMatches(size int64, lastModified *time.Time, info os.FileInfo) bool {
+	if size != info.Size() || lastModified == nil {
+		return false
+	}
+	return !lastModified.Before(info.ModTime().Truncate(time.Second))
+}
+
+// listedContentMatches reports whether a listed object has the same content
+// as the local file without requesting the object headers.
+func listedContentMatches(compare string, listed *object, d digests, info os.FileInfo) bool {
+	switch compare {
+	case compareETag:
+		return listed.etag == d.etag()
+	case compareSizeMtime:
+		return sizeMtimeMatches(listed.size, listed.lastModified, info)
+	}
+	return false
+}
+
+// contentMatches reports whether the remote object has the same content as
+// the local file according to the compare strategy.
+func contentMatches(compare string, head *s3.HeadObjectOutput, d digests, info os.FileInfo) bool {
+	switch compare {
+	case compareSHA256:
+		return head.Metadata[sha256MetadataKey] == hex.EncodeToString(d.sha256)
+	case compareChecksum:
+		return aws.ToString(head.ChecksumSHA256) == d.checksum()
+	case compareSizeMtime:
+		// The modification time recorded at upload is exact, the object
+		// timestamp is only used for objects written by other tools.
+		if mtime, ok := head.Metadata[mtimeMetadataKey]; ok {
+			return aws.ToInt64(head.ContentLength) == info.Size() &&
+				mtime == strconv.FormatInt(info.ModTime().Unix(), 10)
+		}
+		return sizeMtimeMatches(aws.ToInt64(head.ContentLength), head.LastModified, info)
+	}
+
+	if !etagIsMD5(headEncryption(head)) {
+		return strings.EqualFold(head.Metadata[md5MetadataKey], hex.EncodeToString(d.md5))
+	}
+	return aws.ToString(head.ETag) == d.etag()
+}
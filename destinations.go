@@ -0,0 +1,126 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sanitizeDestinations rejects destinations without a bucket or repeating
+// the bucket of another destination.
+func (p *Plugin) sanitizeDestinations() error {
+	buckets := map[string]bool{p.Bucket: true}
+	for i, d := range p.Destinations {
+		if d.Bucket == "" {
+			return fmt.Errorf("destination %d: %s", i, MissingAwsValuesMessage)
+		}
+		if buckets[d.Bucket] {
+			return fmt.Errorf("destination %d: bucket %q is synchronized more than once", i, d.Bucket)
+		}
+		buckets[d.Bucket] = true
+	}
+	return nil
+}
+
+// newDestinations returns the configuration of every bucket, starting with
+// the plugin itself for the top-level bucket, each with its own client.
+func (p *Plugin) newDestinations(ctx context.Context) ([]*Plugin, error) {
+	if len(p.Destinations) == 0 {
+		return []*Plugin{p}, nil
+	}
+
+	primary := *p
+	primary.summary = p.summary.child(p.Bucket)
+	primary.client.plugin = &primary
+	destinations := []*Plugin{&primary}
+
+	for _, d := range p.Destinations {
+		c := *p
+		c.Bucket = d.Bucket
+		c.Region = cmp.Or(d.Region, p.Region)
+		c.Endpoint = cmp.Or(d.Endpoint, p.Endpoint)
+		if d.AccessKey != "" || d.SecretKey != "" {
+			c.Key, c.Secret = d.AccessKey, d.SecretKey
+		}
+		c.PathStyle = *cmp.Or(d.PathStyle, &p.PathStyle)
+		c.CloudFrontDistribution = d.CloudFrontDistribution
+		c.summary = p.summary.child(d.Bucket)
+
+		client, err := NewAWS(ctx, &c)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %w", d.Bucket, err)
+		}
+		c.client = client
+		destinations = append(destinations, &c)
+	}
+	return destinations, nil
+}
+
+// forDestinations returns the configuration of a mapping for every bucket.
+func (p *Plugin) forDestinations(m *Plugin) []*Plugin {
+	if len(p.destinations) == 1 {
+		return []*Plugin{m}
+	}
+
+	plugins := make([]*Plugin, 0, len(p.destinations))
+	for _, d := range p.destinations {
+		c := *m
+		c.Bucket = d.Bucket
+		c.Region = d.Region
+		c.Endpoint = d.Endpoint
+		c.Key, c.Secret = d.Key, d.Secret
+		c.PathStyle = d.PathStyle
+		c.CloudFrontDistribution = d.CloudFrontDistribution
+		c.summary = d.summary
+		c.client = d.client
+		c.client.plugin = &c
+		plugins = append(plugins, &c)
+	}
+	return plugins
+}
+
+// invalidate creates a CloudFront invalidation of all targets for every
+// bucket served by a distribution.
+func (p *Plugin) invalidate(ctx context.Context) error {
+	paths := p.invalidationPaths()
+	var ids []string
+	for _, d := range p.destinations {
+		if d.CloudFrontDistribution == "" {
+			continue
+		}
+
+		var id string
+		n, err := p.retry.do(ctx, func() error {
+			var err error
+			id, err = d.client.Invalidate(ctx, paths)
+			return err
+		})
+		p.summary.addRetries(n)
+		if err != nil {
+			p.summary.setInvalidation("failed", strings.Join(ids, ","))
+			return &InvalidateError{d.CloudFrontDistribution, strings.Join(paths, ", "), err}
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > 0 {
+		p.summary.setInvalidation("created", strings.Join(ids, ","))
+	}
+	return nil
+}
+
+// invalidateAfter invalidates the targets once the jobs have run, unless
+// they were stopped before all of them were started. The error of failed
+// jobs is kept when the invalidation succeeds.
+func (p *Plugin) invalidateAfter(ctx context.Context, err error) error {
+	var jobsErr *JobsError
+	if err != nil && !errors.As(err, &jobsErr) {
+		return err
+	}
+	if ierr := p.invalidate(ctx); ierr != nil {
+		return ierr
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ValidationError is returned for invalid settings.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// ListError is returned when the objects of the target cannot be listed.
+type ListError struct {
+	Prefix string
+	Err    error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("failed to list %q: %v", e.Prefix, e.Err)
+}
+func (e *ListError) Unwrap() error { return e.Err }
+
+// WalkError is returned when the source directory cannot be read.
+type WalkError struct {
+	Path string
+	Err  error
+}
+
+func (e *WalkError) Error() string {
+	return fmt.Sprintf("failed to walk %q: %v", e.Path, e.Err)
+}
+func (e *WalkError) Unwrap() error { return e.Err }
+
+// UploadError is returned when a file cannot be uploaded.
+type UploadError struct {
+	Local   string
+	Remote  string
+	Retries int
+	Err     error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("failed to upload %s to %s after %d retries: %v", e.Local, e.Remote, e.Retries, e.Err)
+}
+func (e *UploadError) Unwrap() error { return e.Err }
+
+// RedirectError is returned when a redirect cannot be created.
+type RedirectError struct {
+	Path     string
+	Location string
+	Retries  int
+	Err      error
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("failed to redirect %s to %s after %d retries: %v", e.Path, e.Location, e.Retries, e.Err)
+}
+func (e *RedirectError) Unwrap() error { return e.Err }
+
+// DeleteError is returned when a remote object cannot be deleted.
+type DeleteError struct {
+	Remote  string
+	Retries int
+	Err     error
+}
+
+func (e *DeleteError) Error() string {
+	return fmt.Sprintf("failed to delete %s after %d retries: %v", e.Remote, e.Retries, e.Err)
+}
+func (e *DeleteError) Unwrap() error { return e.Err }
+
+// InvalidateError is returned when the CloudFront invalidation fails.
+type InvalidateError struct {
+	Distribution string
+	Path         string
+	Err          error
+}
+
+func (e *InvalidateError) Error() string {
+	return fmt.Sprintf("failed to invalidate %s of distribution %s: %v", e.Path, e.Distribution, e.Err)
+}
+func (e *InvalidateError) Unwrap() error { return e.Err }
+
+// ManifestError is returned when the manifest cannot be written.
+type ManifestError struct {
+	Key string
+	Err error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("failed to write manifest %s: %v", e.Key, e.Err)
+}
+func (e *ManifestError) Unwrap() error { return e.Err }
+
+// PreviewError is returned when the marker of a preview cannot be written.
+type PreviewError struct {
+	Prefix string
+	Err    error
+}
+
+func (e *PreviewError) Error() string {
+	return fmt.Sprintf("failed to mark preview %q: %v", e.Prefix, e.Err)
+}
+func (e *PreviewError) Unwrap() error { return e.Err }
+
+// SafetyError is returned when the plugin refuses to continue because the
+// changes would be unsafe.
+type SafetyError struct {
+	Reason string
+}
+
+func (e *SafetyError) Error() string { return "aborted: " + e.Reason }
+
+// CancelledError is returned when the run was cancelled or timed out.
+type CancelledError struct {
+	Err         error
+	Unprocessed []string
+}
+
+func (e *CancelledError) Error() string {
+	if len(e.Unprocessed) == 0 {
+		return fmt.Sprintf("cancelled: %v", e.Err)
+	}
+	return fmt.Sprintf("cancelled with %d objects not processed: %v", len(e.Unprocessed), e.Err)
+}
+func (e *CancelledError) Unwrap() error { return e.Err }
+
+// ErrNoChanges is returned with detailed exit codes when the run succeeded
+// without modifying the bucket.
+var ErrNoChanges = errors.New("no changes")
+
+// JobsError is returned when jobs failed in continue-on-error mode.
+type JobsError struct {
+	Errors []error
+}
+
+func (e *JobsError) Error() string {
+	return fmt.Sprintf("%d jobs failed", len(e.Errors))
+}
+func (e *JobsError) Unwrap() []error { return e.Errors }
+
+// jobError wraps the error of a failed job in the error type of its action.
+func jobError(j job, retries int, err error) error {
+	switch j.action {
+	case "upload":
+		return &UploadError{Local: j.local, Remote: j.remote, Retries: retries, Err: err}
+	case "redirect":
+		return &RedirectError{Path: j.local, Location: j.remote, Retries: retries, Err: err}
+	case "delete":
+		return &DeleteError{Remote: j.remote, Retries: retries, Err: err}
+	}
+	return err
+}
+
+// Exit codes of the plugin:
+//
+//	0  success
+//	1  failure, e.g. the target could not be listed or invalidated
+//	2  invalid settings
+//	3  some jobs failed, the target is partially synchronized
+//	4  aborted by a safety check before making changes
+//	5  success without changes, only with detailed exit codes
+//	6  cancelled or timed out
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitValidation = 2
+	exitPartial    = 3
+	exitSafety     = 4
+	exitNoChanges  = 5
+	exitCancelled  = 6
+)
+
+// exitCode maps an error returned by Plugin.Exec to the exit code.
+func exitCode(err error) int {
+	var (
+		validationErr *ValidationError
+		cancelledErr  *CancelledError
+		safetyErr     *SafetyError
+		jobsErr       *JobsError
+		uploadErr     *UploadError
+		redirectErr   *RedirectError
+		deleteErr     *DeleteError
+	)
+
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, ErrNoChanges):
+		return exitNoChanges
+
+	// Requests like listing the target return the error of the cancelled
+	// context wrapped in the error of the step that was interrupted.
+	case errors.As(err, &cancelledErr),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return exitCancelled
+	case errors.As(err, &validationErr):
+		return exitValidation
+	case errors.As(err, &safetyErr):
+		return exitSafety
+	case errors.As(err, &jobsErr),
+		errors.As(err, &uploadErr),
+		errors.As(err, &redirectErr),
+		errors.As(err, &deleteErr):
+		return exitPartial
+	}
+	return exitFailure
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", err: nil, want: exitOK},
+		{name: "list failure", err: &ListError{"site", failed}, want: exitFailure},
+		{name: "invalidation failure", err: &InvalidateError{"E123", "/*", failed}, want: exitFailure},
+		{name: "validation", err: &ValidationError{failed}, want: exitValidation},
+		{name: "failed jobs", err: &JobsError{[]error{&UploadError{Remote: "a", Err: failed}}}, want: exitPartial},
+		{name: "failed upload", err: &UploadError{Remote: "a", Err: failed}, want: exitPartial},
+		{name: "failed redirect", err: &RedirectError{Path: "a", Err: failed}, want: exitPartial},
+		{name: "failed delete", err: &DeleteError{Remote: "a", Err: failed}, want: exitPartial},
+		{name: "safety check", err: &SafetyError{"empty source"}, want: exitSafety},
+		{name: "no changes", err: ErrNoChanges, want: exitNoChanges},
+		{name: "wrapped no changes", err: fmt.Errorf("run: %w", ErrNoChanges), want: exitNoChanges},
+		{name: "cancelled", err: &CancelledError{Err: context.Canceled}, want: exitCancelled},
+		{name: "cancelled listing", err: &ListError{"site", context.Canceled}, want: exitCancelled},
+		{name: "timed out preview marker", err: &PreviewError{"previews/1", context.DeadlineExceeded}, want: exitCancelled},
+		{name: "timed out invalidation", err: &InvalidateError{"E123", "/*", fmt.Errorf("operation error: %w", context.DeadlineExceeded)}, want: exitCancelled},
+	}
+
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
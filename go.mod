@@ -13,6 +13,7 @@ require (
 	github.com/ryanuber/go-glob v1.0.0
 	github.com/sirupsen/logrus v1.9.0
 	github.com/urfave/cli v1.22.10
+	golang.org/x/text v0.28.0
 )
 
 require (
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journal records the jobs completed by a run, so a rerun of the same plan
+// after a failure or cancellation can skip them. Each entry carries the
+// manifest entry left by its job, so the manifest written by the rerun still
+// describes the objects of the skipped jobs.
+type journal struct {
+	path      string
+	mu        sync.Mutex
+	file      *os.File
+	completed map[string]string
+}
+
+type journalHeader struct {
+	Plan string `json:"plan"`
+}
+
+// openJournal opens the journal at path. Entries are kept when the journal
+// was written for the same plan and discarded otherwise.
+func openJournal(path, plan string) (*journal, error) {
+	j := &journal{path: path, completed: map[string]string{}}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		var header journalHeader
+		if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &header) == nil && header.Plan == plan {
+			for scanner.Scan() {
+				fields := strings.SplitN(scanner.Text(), "\t", journalFields+1)
+				if len(fields) == journalFields+1 {
+					j.completed[strings.Join(fields[:journalFields], "\t")] = fields[journalFields]
+				}
+			}
+		}
+		f.Close()
+	}
+
+	if len(j.completed) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"path":      path,
+			"completed": len(j.completed),
+		}).Info("resuming from journal")
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		j.file = f
+		return j, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(journalHeader{Plan: plan})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.file = f
+	return j, nil
+}
+
+// journalFields is the number of tab separated fields of a journal key.
+const journalFields = 6
+
+// journalKey identifies a job along with the size and modification time of
+// its file, so files changed since the interrupted run are processed again.
+func journalKey(jb job) string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d", jb.mapping.Bucket, jb.action, jb.local, jb.remote, jb.size, jb.mtime)
+}
+
+// done reports whether the job was completed by a previous run, replaying
+// its change to the manifest of its mapping.
+func (j *journal) done(jb job) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	entry, ok := j.completed[journalKey(jb)]
+	j.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	m := jb.mapping.manifest
+	switch {
+	case jb.action == "delete":
+		m.remove(jb.remote)
+	case entry != "":
+		var e manifestEntry
+		if err := json.Unmarshal([]byte(entry), &e); err != nil {
+			return false
+		}
+		m.record(jb.manifestKey(), e)
+	}
+	return true
+}
+
+// record appends a completed job to the journal along with the manifest
+// entry of its object.
+func (j *journal) record(jb job) {
+	if j == nil {
+		return
+	}
+
+	var entry []byte
+	if e, ok := jb.mapping.manifest.entry(jb.manifestKey()); ok && jb.action != "delete" {
+		entry, _ = json.Marshal(e)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := fmt.Fprintf(j.file, "%s\t%s\n", journalKey(jb), entry); err != nil {
+		logrus.WithError(err).WithField("path", j.path).Warn("failed to write journal")
+	}
+}
+
+// close closes the journal, removing it when the run completed.
+func (j *journal) close(completed bool) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if completed {
+		return os.Remove(j.path)
+	}
+	return nil
+}
+
+// planHash identifies the plan of a run by its settings. Whether a file is
+// unchanged since its job was completed is told by the journal entry, so the
+// plan does not need to be known in full before the first job starts.
+func (p *Plugin) planHash() string {
+	settings, _ := json.Marshal([]any{
+		p.Bucket, p.Target, p.Source, p.Compare, p.Manifest,
+		p.Access, p.CacheControl, p.ContentType, p.ContentEncoding, p.Metadata,
+		p.SSE, p.SSEKMSKeyID, p.SSEBucketKey, p.Mappings, p.Destinations,
+	})
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:])
+}
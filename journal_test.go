@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplaysManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	previous := &manifest{Objects: map[string]manifestEntry{"site/old.html": {MD5: "old"}}}
+
+	mapping := &Plugin{Bucket: "bucket", manifest: newManifest(previous, "")}
+	upload := job{local: "/src/index.html", remote: "site/index.html", action: "upload", size: 3, mtime: 1, mapping: mapping}
+	remove := job{remote: "site/old.html", action: "delete", mapping: mapping}
+
+	j, err := openJournal(path, "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping.manifest.record(upload.remote, manifestEntry{MD5: "new"})
+	j.record(upload)
+	mapping.manifest.remove(remove.remote)
+	j.record(remove)
+	if err := j.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The resumed run starts from the manifest of the run before the
+	// interrupted one.
+	mapping.manifest = newManifest(previous, "")
+	j, err = openJournal(path, "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close(true)
+
+	if !j.done(upload) || !j.done(remove) {
+		t.Fatal("jobs completed by the interrupted run are not done")
+	}
+	if e, ok := mapping.manifest.entry(upload.remote); !ok || e.MD5 != "new" {
+		t.Errorf("manifest entry of the upload = %+v, %v, want the entry of the interrupted run", e, ok)
+	}
+	if _, ok := mapping.manifest.entry(remove.remote); ok {
+		t.Error("manifest still has the object deleted by the interrupted run")
+	}
+
+	changed := upload
+	changed.size = 4
+	if j.done(changed) {
+		t.Error("job of a file changed since the interrupted run is done")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// latencySpike is the factor over the average request latency at which a
+	// request is considered a sign of an overloaded endpoint.
+	latencySpike = 4
+
+	// minLatencySpike keeps short requests from being treated as spikes.
+	minLatencySpike = 2 * time.Second
+
+	// decreaseCooldown limits how often the concurrency is lowered, so the
+	// requests already in flight during a throttling burst count only once.
+	decreaseCooldown = time.Second
+)
+
+// throttlingCodes are error codes returned by endpoints asking clients to
+// slow down.
+var throttlingCodes = map[string]bool{
+	"SlowDown":                 true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"ServiceUnavailable":       true,
+	"TooManyRequests":          true,
+	"RequestThrottled":         true,
+	"TooManyRequestsException": true,
+}
+
+// limiter bounds the number of requests in flight. In adaptive mode the limit
+// is halved when the endpoint throttles or latency spikes, and raised by one
+// again after a full window of successful requests, never exceeding max.
+type limiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	adaptive  bool
+	limit     int
+	max       int
+	inFlight  int
+	successes int
+	latency   time.Duration
+	decreased time.Time
+}
+
+func newLimiter(initial, max int, adaptive bool) *limiter {
+	if max < 1 {
+		max = 1
+	}
+	if !adaptive || initial < 1 || initial > max {
+		initial = max
+	}
+
+	l := &limiter{adaptive: adaptive, limit: initial, max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until another request may be started.
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// release frees the slot of a finished request.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.cond.Broadcast()
+}
+
+// observe adjusts the limit according to the outcome of a request.
+func (l *limiter) observe(err error, took time.Duration) {
+	if !l.adaptive {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err != nil {
+		if throttled(err) {
+			l.decrease("throttling")
+		}
+		return
+	}
+
+	if l.latency > 0 && took > latencySpike*l.latency && took > minLatencySpike {
+		l.decrease("latency spike")
+		return
+	}
+
+	// Exponentially weighted moving average of the successful requests.
+	if l.latency == 0 {
+		l.latency = took
+	} else {
+		l.latency += (took - l.latency) / 8
+	}
+
+	l.successes++
+	if l.successes >= l.limit && l.limit < l.max {
+		l.limit++
+		l.successes = 0
+		l.cond.Broadcast()
+	}
+}
+
+func (l *limiter) decrease(reason string) {
+	l.successes = 0
+	if time.Since(l.decreased) < decreaseCooldown || l.limit == 1 {
+		return
+	}
+
+	l.limit = max(1, l.limit/2)
+	l.decreased = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"concurrency": l.limit,
+		"reason":      reason,
+	}).Info("lowering concurrency")
+}
+
+// throttled reports whether err asks the client to send fewer requests.
+func throttled(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && throttlingCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == 429 || status == 503
+	}
+	return false
+}
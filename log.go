@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogging configures the level and format of the log output. Setting
+// the DEBUG environment variable still enables debug output.
+func setupLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if os.Getenv("DEBUG") != "" {
+		lvl = logrus.DebugLevel
+	}
+
+	switch format {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, must be text or json", format)
+	}
+
+	logrus.SetOutput(os.Stdout)
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+// progress periodically logs how many jobs have finished out of the jobs
+// planned so far.
+type progress struct {
+	total    atomic.Int64
+	finished atomic.Int64
+	ticker   *time.Ticker
+	quit     chan struct{}
+}
+
+// startProgress starts logging the progress if an interval is configured.
+func (p *Plugin) startProgress() *progress {
+	if p.Progress <= 0 {
+		return nil
+	}
+
+	pr := &progress{
+		ticker: time.NewTicker(p.Progress),
+		quit:   make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-pr.ticker.C:
+				finished, total := pr.finished.Load(), pr.total.Load()
+				logrus.WithFields(logrus.Fields{
+					"finished": finished,
+					"total":    total,
+					"percent":  fmt.Sprintf("%.1f", 100*float64(finished)/float64(max(total, 1))),
+				}).Info("progress")
+			case <-pr.quit:
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+func (pr *progress) planned() {
+	if pr != nil {
+		pr.total.Add(1)
+	}
+}
+
+func (pr *progress) done() {
+	if pr != nil {
+		pr.finished.Add(1)
+	}
+}
+
+func (pr *progress) stop() {
+	if pr != nil {
+		pr.ticker.Stop()
+		close(pr.quit)
+	}
+}
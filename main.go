@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
@@ -58,7 +63,7 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "target",
-			Usage:  "target path",
+			Usage:  "target path, may be a template using build variables",
 			Value:  "/",
 			EnvVar: "PLUGIN_TARGET",
 		},
@@ -97,12 +102,123 @@ func main() {
 			EnvVar: "PLUGIN_METADATA",
 			Value:  &DeepStringMapFlag{},
 		},
+		cli.GenericFlag{
+			Name:   "destinations",
+			Usage:  "additional buckets to synchronize with their own region, endpoint and credentials",
+			EnvVar: "PLUGIN_DESTINATIONS",
+			Value:  &DestinationsFlag{},
+		},
+		cli.BoolFlag{
+			Name:   "require-all-destinations",
+			Usage:  "only delete objects once all buckets have been synchronized",
+			EnvVar: "PLUGIN_REQUIRE_ALL_DESTINATIONS",
+		},
+		cli.GenericFlag{
+			Name:   "mappings",
+			Usage:  "list of source to target mappings with their own rules",
+			EnvVar: "PLUGIN_MAPPINGS",
+			Value:  &MappingsFlag{},
+		},
 		cli.GenericFlag{
 			Name:   "redirects",
 			Usage:  "redirects to create",
 			EnvVar: "PLUGIN_REDIRECTS",
 			Value:  &MapFlag{},
 		},
+		cli.GenericFlag{
+			Name:   "sse",
+			Usage:  "server-side encryption for uploads (AES256, aws:kms, aws:kms:dsse or SSE-C)",
+			EnvVar: "PLUGIN_SSE",
+			Value:  &StringMapFlag{},
+		},
+		cli.GenericFlag{
+			Name:   "sse-kms-key-id",
+			Usage:  "kms key id, key arn or alias for aws:kms encrypted uploads, existing objects are not re-encrypted when an alias points to another key",
+			EnvVar: "PLUGIN_SSE_KMS_KEY_ID",
+			Value:  &StringMapFlag{},
+		},
+		cli.BoolFlag{
+			Name:   "sse-bucket-key",
+			Usage:  "use an s3 bucket key for aws:kms encrypted uploads",
+			EnvVar: "PLUGIN_SSE_BUCKET_KEY",
+		},
+		cli.StringFlag{
+			Name:   "sse-c-key",
+			Usage:  "base64 encoded 256-bit key for SSE-C encrypted uploads",
+			EnvVar: "PLUGIN_SSE_C_KEY",
+		},
+		cli.StringFlag{
+			Name:   "compare",
+			Usage:  "strategy to detect changed files (etag, sha256, checksum or size-mtime)",
+			Value:  "etag",
+			EnvVar: "PLUGIN_COMPARE",
+		},
+		cli.StringFlag{
+			Name:   "symlinks",
+			Usage:  "handling of symbolic links in the source (follow, skip or error)",
+			Value:  "follow",
+			EnvVar: "PLUGIN_SYMLINKS",
+		},
+		cli.BoolFlag{
+			Name:   "symlink-redirects",
+			Usage:  "turn symbolic links to files of the source into website redirects",
+			EnvVar: "PLUGIN_SYMLINK_REDIRECTS",
+		},
+		cli.StringFlag{
+			Name:   "unicode-normalization",
+			Usage:  "normalize keys to the nfc or nfd unicode form",
+			EnvVar: "PLUGIN_UNICODE_NORMALIZATION",
+		},
+		cli.StringFlag{
+			Name:   "hash-cache",
+			Usage:  "file to cache digests of unchanged local files between builds",
+			EnvVar: "PLUGIN_HASH_CACHE",
+		},
+		cli.BoolFlag{
+			Name:   "preview",
+			Usage:  "deploy a preview to the target and mark it for cleanup",
+			EnvVar: "PLUGIN_PREVIEW",
+		},
+		cli.BoolFlag{
+			Name:   "preview-cleanup",
+			Usage:  "delete the previews below the target that are closed or expired",
+			EnvVar: "PLUGIN_PREVIEW_CLEANUP",
+		},
+		cli.DurationFlag{
+			Name:   "preview-max-age",
+			Usage:  "age after which previews not updated are deleted by the cleanup",
+			EnvVar: "PLUGIN_PREVIEW_MAX_AGE",
+		},
+		cli.StringSliceFlag{
+			Name:   "preview-closed",
+			Usage:  "pull requests whose previews are deleted by the cleanup",
+			EnvVar: "PLUGIN_PREVIEW_CLOSED",
+		},
+		cli.StringFlag{
+			Name:   "journal",
+			Usage:  "file recording completed jobs to resume an interrupted run",
+			EnvVar: "PLUGIN_JOURNAL",
+		},
+		cli.BoolFlag{
+			Name:   "manifest",
+			Usage:  "plan with a manifest stored in the target instead of listing it",
+			EnvVar: "PLUGIN_MANIFEST",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Usage:  "commit recorded in the manifest",
+			EnvVar: "PLUGIN_COMMIT,DRONE_COMMIT_SHA",
+		},
+		cli.StringFlag{
+			Name:   "url",
+			Usage:  "base url of the site for links to changed objects",
+			EnvVar: "PLUGIN_URL",
+		},
+		cli.StringFlag{
+			Name:   "release-id",
+			Usage:  "id of the release exported to later steps",
+			EnvVar: "PLUGIN_RELEASE_ID,DRONE_BUILD_NUMBER",
+		},
 		cli.StringFlag{
 			Name:   "cloudfront-distribution",
 			Usage:  "id of cloudfront distribution to invalidate",
@@ -113,6 +229,23 @@ func main() {
 			Usage:  "dry run disables api calls",
 			EnvVar: "DRY_RUN,PLUGIN_DRY_RUN",
 		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "log level (debug, info, warn or error)",
+			Value:  "info",
+			EnvVar: "PLUGIN_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "log format (text or json)",
+			Value:  "text",
+			EnvVar: "PLUGIN_LOG_FORMAT",
+		},
+		cli.DurationFlag{
+			Name:   "progress",
+			Usage:  "interval to log the progress at, disabled when zero",
+			EnvVar: "PLUGIN_PROGRESS",
+		},
 		cli.StringFlag{
 			Name:  "env-file",
 			Usage: "source env file",
@@ -123,10 +256,68 @@ func main() {
 			Value:  100,
 			EnvVar: "PLUGIN_MAX_CONCURRENCY",
 		},
+		cli.IntFlag{
+			Name:   "hash-concurrency",
+			Usage:  "number of files hashed concurrently, defaults to the number of CPUs",
+			EnvVar: "PLUGIN_HASH_CONCURRENCY",
+		},
+		cli.BoolFlag{
+			Name:   "adaptive-concurrency",
+			Usage:  "lower concurrency on throttling and raise it again up to max-concurrency",
+			EnvVar: "PLUGIN_ADAPTIVE_CONCURRENCY",
+		},
+		cli.IntFlag{
+			Name:   "initial-concurrency",
+			Usage:  "concurrency to start with in adaptive mode",
+			Value:  16,
+			EnvVar: "PLUGIN_INITIAL_CONCURRENCY",
+		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "maximum duration of the run, disabled when zero",
+			EnvVar: "PLUGIN_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "grace-period",
+			Usage:  "time given to requests in flight to finish after cancellation",
+			Value:  10 * time.Second,
+			EnvVar: "PLUGIN_GRACE_PERIOD",
+		},
+		cli.BoolFlag{
+			Name:   "continue-on-error",
+			Usage:  "finish all jobs after a failure and report all failures at the end",
+			EnvVar: "PLUGIN_CONTINUE_ON_ERROR",
+		},
+		cli.BoolFlag{
+			Name:   "detailed-exit-codes",
+			Usage:  "exit with code 5 when the run made no changes",
+			EnvVar: "PLUGIN_DETAILED_EXIT_CODES",
+		},
+		cli.IntFlag{
+			Name:   "retries",
+			Usage:  "number of retries for jobs failing with transient errors",
+			Value:  3,
+			EnvVar: "PLUGIN_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "retry-delay",
+			Usage:  "base delay of the exponential backoff between retries",
+			Value:  500 * time.Millisecond,
+			EnvVar: "PLUGIN_RETRY_DELAY",
+		},
+		cli.DurationFlag{
+			Name:   "retry-max-delay",
+			Usage:  "maximum delay between retries",
+			Value:  20 * time.Second,
+			EnvVar: "PLUGIN_RETRY_MAX_DELAY",
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		logrus.Fatal(err)
+		if !errors.Is(err, ErrNoChanges) {
+			logrus.Error(err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -134,6 +325,9 @@ func run(c *cli.Context) error {
 	if c.String("env-file") != "" {
 		_ = godotenv.Load(c.String("env-file"))
 	}
+	if err := setupLogging(c.String("log-level"), c.String("log-format")); err != nil {
+		return &ValidationError{err}
+	}
 	plugin := Plugin{
 		Endpoint:               c.String("endpoint"),
 		PathStyle:              c.Bool("path-style"),
@@ -150,10 +344,49 @@ func run(c *cli.Context) error {
 		ContentEncoding:        c.Generic("content-encoding").(*StringMapFlag).Get(),
 		Metadata:               c.Generic("metadata").(*DeepStringMapFlag).Get(),
 		Redirects:              c.Generic("redirects").(*MapFlag).Get(),
+		Mappings:               c.Generic("mappings").(*MappingsFlag).Get(),
+		Destinations:           c.Generic("destinations").(*DestinationsFlag).Get(),
+		RequireAllDestinations: c.Bool("require-all-destinations"),
+		SSE:                    c.Generic("sse").(*StringMapFlag).Get(),
+		SSEKMSKeyID:            c.Generic("sse-kms-key-id").(*StringMapFlag).Get(),
+		SSEBucketKey:           c.Bool("sse-bucket-key"),
+		SSECustomerKey:         c.String("sse-c-key"),
 		CloudFrontDistribution: c.String("cloudfront-distribution"),
 		DryRun:                 c.Bool("dry-run"),
+		Compare:                c.String("compare"),
+		UnicodeNormalization:   c.String("unicode-normalization"),
+		Symlinks:               c.String("symlinks"),
+		SymlinkRedirects:       c.Bool("symlink-redirects"),
+		HashCache:              c.String("hash-cache"),
+		Journal:                c.String("journal"),
+		Preview:                c.Bool("preview"),
+		PreviewCleanup:         c.Bool("preview-cleanup"),
+		PreviewMaxAge:          c.Duration("preview-max-age"),
+		PreviewClosed:          c.StringSlice("preview-closed"),
+		Manifest:               c.Bool("manifest"),
+		Commit:                 c.String("commit"),
+		URL:                    c.String("url"),
+		ReleaseID:              c.String("release-id"),
 		MaxConcurrency:         c.Int("max-concurrency"),
+		HashConcurrency:        c.Int("hash-concurrency"),
+		Progress:               c.Duration("progress"),
+		InitialConcurrency:     c.Int("initial-concurrency"),
+		AdaptiveConcurrency:    c.Bool("adaptive-concurrency"),
+		ContinueOnError:        c.Bool("continue-on-error"),
+		DetailedExitCodes:      c.Bool("detailed-exit-codes"),
+		Retries:                c.Int("retries"),
+		RetryDelay:             c.Duration("retry-delay"),
+		RetryMaxDelay:          c.Duration("retry-max-delay"),
+		GracePeriod:            c.Duration("grace-period"),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	return plugin.Exec()
+	return plugin.Exec(ctx)
 }
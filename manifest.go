@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"path"
+	"sync"
+)
+
+const (
+	manifestName    = ".s3sync-manifest.json"
+	manifestVersion = 1
+)
+
+// manifest records the objects written by previous runs, so the next run can
+// plan without listing the target or requesting the headers of each object.
+type manifest struct {
+	mu      sync.Mutex
+	Version int                      `json:"version"`
+	Commit  string                   `json:"commit,omitempty"`
+	Objects map[string]manifestEntry `json:"objects"`
+}
+
+type manifestEntry struct {
+	Size            int64             `json:"size,omitempty"`
+	Mtime           int64             `json:"mtime,omitempty"`
+	MD5             string            `json:"md5,omitempty"`
+	SHA256          string            `json:"sha256,omitempty"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	CacheControl    string            `json:"cache_control,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	ACL             string            `json:"acl,omitempty"`
+	SSE             string            `json:"sse,omitempty"`
+	SSEKMSKeyID     string            `json:"sse_kms_key_id,omitempty"`
+	Redirect        string            `json:"redirect,omitempty"`
+	Commit          string            `json:"commit,omitempty"`
+}
+
+// manifestKey returns the key of the object of a job in the manifest. Redirects
+// are written to their local path.
+func (j job) manifestKey() string {
+	if j.action == "redirect" {
+		return j.local
+	}
+	return j.remote
+}
+
+// manifestKey returns the key of the manifest for the target prefix.
+func manifestKey(target string) string {
+	return path.Join(target, manifestName)
+}
+
+// newManifest returns the manifest written by this run, starting from the
+// entries of the previous manifest if there is one.
+func newManifest(previous *manifest, commit string) *manifest {
+	m := &manifest{
+		Version: manifestVersion,
+		Commit:  commit,
+		Objects: map[string]manifestEntry{},
+	}
+	if previous != nil {
+		maps.Copy(m.Objects, previous.Objects)
+	}
+	return m
+}
+
+func (m *manifest) validate() error {
+	if m.Version != manifestVersion {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.Objects == nil {
+		return fmt.Errorf("manifest has no objects")
+	}
+	return nil
+}
+
+// objects returns the recorded objects in the form returned by List.
+func (m *manifest) objects() []object {
+	remote := make([]object, 0, len(m.Objects))
+	for key, entry := range m.Objects {
+		o := object{
+			key:      key,
+			size:     entry.Size,
+			recorded: &entry,
+		}
+		if entry.MD5 != "" && etagIsMD5(entry.SSE) {
+			o.etag = fmt.Sprintf("\"%s\"", entry.MD5)
+		}
+		remote = append(remote, o)
+	}
+	return remote
+}
+
+// record stores the entry of an object written or verified by this run.
+func (m *manifest) record(key string, entry manifestEntry) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Objects[key] = entry
+}
+
+// entry returns the entry recorded for an object.
+func (m *manifest) entry(key string) (manifestEntry, bool) {
+	if m == nil {
+		return manifestEntry{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.Objects[key]
+	return e, ok
+}
+
+// remove drops an object deleted by this run.
+func (m *manifest) remove(key string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.Objects, key)
+}
+
+// matches reports whether the recorded entry describes an object with the
+// same content and headers as the desired one.
+func (e *manifestEntry) matches(desired manifestEntry, compare string) (content bool, headers bool) {
+	switch compare {
+	case compareETag:
+		content = e.MD5 != "" && e.MD5 == desired.MD5
+	case compareSizeMtime:
+		content = e.Size == desired.Size && e.Mtime == desired.Mtime
+	default:
+		content = e.SHA256 != "" && e.SHA256 == desired.SHA256
+	}
+
+	headers = e.ContentType == desired.ContentType &&
+		e.ContentEncoding == desired.ContentEncoding &&
+		e.CacheControl == desired.CacheControl &&
+		e.ACL == desired.ACL &&
+		e.SSE == desired.SSE &&
+		e.SSEKMSKeyID == desired.SSEKMSKeyID &&
+		maps.Equal(e.Metadata, desired.Metadata)
+
+	return content, headers
+}
+
+// manifestEntryFor describes an uploaded file for the manifest.
+func manifestEntryFor(d digests, size, mtime int64) manifestEntry {
+	entry := manifestEntry{Size: size, Mtime: mtime}
+	if d.md5 != nil {
+		entry.MD5 = hex.EncodeToString(d.md5)
+	}
+	if d.sha256 != nil {
+		entry.SHA256 = hex.EncodeToString(d.sha256)
+	}
+	return entry
+}
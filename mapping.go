@@ -0,0 +1,123 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sanitizeMappings resolves the source and target of every mapping, validates
+// its encryption rules and rejects mappings sharing a target or deleting
+// below the target of another mapping.
+func (p *Plugin) sanitizeMappings(wd string) error {
+	if len(p.Mappings) == 0 {
+		return nil
+	}
+	if p.Preview || p.PreviewCleanup {
+		return errors.New("'mappings' cannot be combined with previews")
+	}
+	if len(p.Redirects) > 0 {
+		return errors.New("'redirects' cannot be combined with 'mappings', set them on a mapping instead")
+	}
+
+	targets := map[string]int{}
+	for i := range p.Mappings {
+		m := &p.Mappings[i]
+		if m.Source == "" {
+			return fmt.Errorf("mapping %d: must set 'source'", i)
+		}
+		m.Source = filepath.Join(wd, m.Source)
+
+		target, err := resolveTarget(m.Target)
+		if err != nil {
+			return fmt.Errorf("mapping %d: %w", i, err)
+		}
+		m.Target = target
+
+		// Mappings sharing a target would overwrite the manifest of each other.
+		if j, ok := targets[target]; ok {
+			return fmt.Errorf("mappings %d and %d both synchronize %q", j, i, "/"+target)
+		}
+		targets[target] = i
+
+		if err := validateSSE(m.SSE, p.SSECustomerKey); err != nil {
+			return fmt.Errorf("mapping %d: %w", i, err)
+		}
+	}
+
+	for i, m := range p.Mappings {
+		if !*cmp.Or(m.Delete, &p.Delete) {
+			continue
+		}
+		for j, other := range p.Mappings {
+			if i != j && (m.Target == "" || strings.HasPrefix(other.Target, targetPrefix(m.Target))) {
+				return fmt.Errorf("mapping %d deletes below %q, the target of mapping %d", i, "/"+m.Target, j)
+			}
+		}
+	}
+
+	return nil
+}
+
+// forMappings returns the configuration of every mapping, or the plugin
+// itself without mappings. The configurations share the client, summary
+// and caches of the plugin.
+func (p *Plugin) forMappings() []*Plugin {
+	if len(p.Mappings) == 0 {
+		return []*Plugin{p}
+	}
+
+	plugins := make([]*Plugin, 0, len(p.Mappings))
+	for _, m := range p.Mappings {
+		c := *p
+		c.Mappings = nil
+		c.Source = m.Source
+		c.Target = m.Target
+		c.Delete = *cmp.Or(m.Delete, &p.Delete)
+		c.Access = inherit(m.Access, p.Access)
+		c.CacheControl = inherit(m.CacheControl, p.CacheControl)
+		c.ContentType = inherit(m.ContentType, p.ContentType)
+		c.ContentEncoding = inherit(m.ContentEncoding, p.ContentEncoding)
+		c.Metadata = inherit(m.Metadata, p.Metadata)
+		c.Redirects = m.Redirects
+		c.SSE = inherit(m.SSE, p.SSE)
+		c.SSEKMSKeyID = inherit(m.SSEKMSKeyID, p.SSEKMSKeyID)
+		c.client.plugin = &c
+		plugins = append(plugins, &c)
+	}
+	return plugins
+}
+
+// inherit returns the rules of a mapping, or the top-level rules when the
+// mapping does not set any.
+func inherit[M ~map[K]V, K comparable, V any](rules, fallback M) M {
+	if rules != nil {
+		return rules
+	}
+	return fallback
+}
+
+// targets returns the targets of all mappings.
+func (p *Plugin) targets() []string {
+	if len(p.Mappings) == 0 {
+		return []string{p.Target}
+	}
+
+	targets := make([]string, 0, len(p.Mappings))
+	for _, m := range p.Mappings {
+		targets = append(targets, m.Target)
+	}
+	return targets
+}
+
+// invalidationPaths returns the CloudFront paths covering all targets.
+func (p *Plugin) invalidationPaths() []string {
+	var paths []string
+	for _, target := range p.targets() {
+		paths = append(paths, path.Join("/", target, "*"))
+	}
+	return paths
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestSanitizeMappings(t *testing.T) {
+	yes := true
+
+	tests := []struct {
+		name      string
+		mappings  []Mapping
+		redirects map[string]string
+		err       bool
+	}{
+		{
+			name:     "separate targets",
+			mappings: []Mapping{{Source: "app", Target: "app"}, {Source: "docs", Target: "docs", Delete: &yes}},
+		},
+		{
+			name:     "same target without delete",
+			mappings: []Mapping{{Source: "app", Target: "site"}, {Source: "docs", Target: "/site/"}},
+			err:      true,
+		},
+		{
+			name:     "delete below another target",
+			mappings: []Mapping{{Source: "app", Target: "site", Delete: &yes}, {Source: "docs", Target: "site/docs"}},
+			err:      true,
+		},
+		{
+			name:     "delete next to a target sharing its prefix",
+			mappings: []Mapping{{Source: "app", Target: "docs", Delete: &yes}, {Source: "docs", Target: "docs-old"}},
+		},
+		{
+			name:      "top-level redirects",
+			mappings:  []Mapping{{Source: "app", Target: "app"}},
+			redirects: map[string]string{"old.html": "/app/"},
+			err:       true,
+		},
+		{
+			name:     "mapping redirects",
+			mappings: []Mapping{{Source: "app", Target: "app", Redirects: map[string]string{"app/old.html": "/app/"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		p := &Plugin{Mappings: tt.mappings, Redirects: tt.redirects}
+		if err := p.sanitizeMappings("/src"); (err != nil) != tt.err {
+			t.Errorf("%s: sanitizeMappings() error = %v, want an error %v", tt.name, err, tt.err)
+		}
+	}
+}
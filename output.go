@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cardSchema = "https://drone-plugins.github.io/drone-s3-sync/card.json"
+
+	// cardLinks limits the number of changed objects linked from the card.
+	cardLinks = 50
+
+	// outputURLs limits the number of changed objects exported as URLs, so
+	// the step output stays a reasonable size for full deployments.
+	outputURLs = 1000
+)
+
+type card struct {
+	Schema string   `json:"schema"`
+	Data   cardData `json:"data"`
+}
+
+type cardData struct {
+	Bucket         string       `json:"bucket"`
+	Target         string       `json:"target"`
+	ReleaseID      string       `json:"release_id,omitempty"`
+	PreviewURL     string       `json:"preview_url,omitempty"`
+	InvalidationID string       `json:"invalidation_id,omitempty"`
+	Invalidation   string       `json:"invalidation"`
+	Duration       string       `json:"duration"`
+	Totals         []cardTotal  `json:"totals"`
+	Buckets        []cardBucket `json:"buckets"`
+	Links          []cardLink   `json:"links"`
+	MoreLinks      int          `json:"more_links,omitempty"`
+}
+
+type cardTotal struct {
+	Outcome string `json:"outcome"`
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type cardBucket struct {
+	Bucket  string `json:"bucket"`
+	Changed int    `json:"changed"`
+	Failed  int    `json:"failed"`
+}
+
+type cardLink struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+// writeOutputs exports the results of the run to later pipeline steps as
+// step outputs and as an adaptive card.
+func (p *Plugin) writeOutputs() error {
+	if path := os.Getenv("DRONE_OUTPUT"); path != "" {
+		if err := p.writeStepOutputs(path); err != nil {
+			return fmt.Errorf("failed to write step outputs: %w", err)
+		}
+	}
+	if path := os.Getenv("DRONE_CARD_PATH"); path != "" {
+		if err := p.writeCard(path); err != nil {
+			return fmt.Errorf("failed to write card: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) writeStepOutputs(path string) error {
+	s := p.summary
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := sortedKeys(s.changed)
+	urls := make([]string, 0, min(len(changed), outputURLs))
+	for _, key := range changed[:min(len(changed), outputURLs)] {
+		urls = append(urls, p.objectURL(key))
+	}
+
+	lines := []string{}
+	for _, outcome := range outcomes {
+		name := "S3_SYNC_" + strings.ToUpper(strings.ReplaceAll(outcome, " ", "_"))
+		lines = append(lines,
+			fmt.Sprintf("%s=%d", name, s.counts[outcome]),
+			fmt.Sprintf("%s_BYTES=%d", name, s.bytes[outcome]),
+		)
+	}
+	lines = append(lines,
+		"S3_SYNC_CHANGED_URLS="+strings.Join(urls, ","),
+		fmt.Sprintf("S3_SYNC_CHANGED_URLS_OMITTED=%d", len(changed)-len(urls)),
+		"S3_SYNC_INVALIDATION_ID="+s.invalidationID,
+		"S3_SYNC_RELEASE_ID="+p.ReleaseID,
+	)
+	if len(s.buckets) > 0 {
+		var failed []string
+		for _, b := range s.buckets {
+			b.mu.Lock()
+			if b.counts[outcomeFailed] > 0 {
+				failed = append(failed, b.bucket)
+			}
+			b.mu.Unlock()
+		}
+		lines = append(lines, "S3_SYNC_FAILED_BUCKETS="+strings.Join(failed, ","))
+	}
+	if p.Preview {
+		lines = append(lines, "S3_SYNC_PREVIEW_URL="+p.previewURL())
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+func (p *Plugin) writeCard(path string) error {
+	s := p.summary
+	s.mu.Lock()
+	data := cardData{
+		Bucket:         p.Bucket,
+		Target:         "/" + strings.Join(p.targets(), ", /"),
+		ReleaseID:      p.ReleaseID,
+		InvalidationID: s.invalidationID,
+		Invalidation:   s.invalidation,
+		Duration:       time.Since(s.started).Round(time.Second).String(),
+		Links:          []cardLink{},
+	}
+	for _, outcome := range outcomes {
+		data.Totals = append(data.Totals, cardTotal{outcome, s.counts[outcome], s.bytes[outcome]})
+	}
+	for _, b := range s.buckets {
+		b.mu.Lock()
+		data.Buckets = append(data.Buckets, cardBucket{b.bucket, len(b.changed), b.counts[outcomeFailed]})
+		b.mu.Unlock()
+	}
+	changed := sortedKeys(s.changed)
+	for i, key := range changed {
+		if i == cardLinks {
+			data.MoreLinks = len(changed) - cardLinks
+			break
+		}
+		data.Links = append(data.Links, cardLink{key, p.objectURL(key)})
+	}
+	s.mu.Unlock()
+
+	if p.Preview {
+		data.PreviewURL = p.previewURL()
+	}
+	if data.Invalidation == "" {
+		data.Invalidation = "none"
+	}
+
+	out, err := json.Marshal(card{Schema: cardSchema, Data: data})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// objectURL returns the URL an object is served at.
+func (p *Plugin) objectURL(key string) string {
+	base := p.URL
+	if base == "" {
+		switch {
+		case p.Endpoint != "" && p.PathStyle:
+			base = fmt.Sprintf("%s/%s", normalizeEndpoint(p.Endpoint), p.Bucket)
+		case p.Endpoint != "":
+			base = normalizeEndpoint(p.Endpoint)
+		default:
+			base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", p.Bucket, p.Region)
+		}
+	}
+
+	u := url.URL{Path: "/" + key}
+	return strings.TrimSuffix(base, "/") + u.EscapedPath()
+}
+
+// previewURL returns the URL the preview deployed to the target is served at.
+func (p *Plugin) previewURL() string {
+	return p.objectURL(targetPrefix(p.Target))
+}
+
+// sortedKeys returns the keys sorted and without the duplicates of keys
+// changed in several buckets.
+func sortedKeys(keys []string) []string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	return slices.Compact(sorted)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteStepOutputsLimitsURLs(t *testing.T) {
+	p := &Plugin{Bucket: "site", URL: "https://example.com", summary: newSummary()}
+	for i := range outputURLs + 5 {
+		p.summary.changed = append(p.summary.changed, fmt.Sprintf("file%05d.html", i))
+	}
+
+	path := filepath.Join(t.TempDir(), "output")
+	if err := p.writeStepOutputs(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		outputs[name] = value
+	}
+	if got := len(strings.Split(outputs["S3_SYNC_CHANGED_URLS"], ",")); got != outputURLs {
+		t.Errorf("exported %d URLs, want %d", got, outputURLs)
+	}
+	if got := outputs["S3_SYNC_CHANGED_URLS_OMITTED"]; got != "5" {
+		t.Errorf("S3_SYNC_CHANGED_URLS_OMITTED = %s, want 5", got)
+	}
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
 )
 
 type Plugin struct {
@@ -23,40 +37,206 @@ type Plugin struct {
 	ContentEncoding        map[string]string
 	Metadata               map[string]map[string]string
 	Redirects              map[string]string
+	Mappings               []Mapping
+	Destinations           []Destination
+	RequireAllDestinations bool
+	SSE                    map[string]string
+	SSEKMSKeyID            map[string]string
+	SSEBucketKey           bool
+	SSECustomerKey         string
 	CloudFrontDistribution string
 	DryRun                 bool
 	PathStyle              bool
+	Compare                string
+	UnicodeNormalization   string
+	Symlinks               string
+	SymlinkRedirects       bool
+	HashCache              string
+	Manifest               bool
+	Commit                 string
+	DetailedExitCodes      bool
+	URL                    string
+	ReleaseID              string
+	cache                  *hashCache
+	summary                *summary
+	manifest               *manifest
 	client                 AWS
-	jobs                   []job
 	MaxConcurrency         int
+	HashConcurrency        int
+	Progress               time.Duration
+	ContinueOnError        bool
+	InitialConcurrency     int
+	AdaptiveConcurrency    bool
+	Retries                int
+	RetryDelay             time.Duration
+	RetryMaxDelay          time.Duration
+	GracePeriod            time.Duration
+	Journal                string
+	Preview                bool
+	PreviewCleanup         bool
+	PreviewMaxAge          time.Duration
+	PreviewClosed          []string
+	journal                *journal
+	destinations           []*Plugin
+	retry                  retryPolicy
 }
 
 type job struct {
 	local  string
 	remote string
 	action string
+	size   int64
+	mtime  int64
+	object *object
+	info   os.FileInfo
+	sums   digests
+	body   []byte
+
+	// mapping is the configuration of the mapping the job was planned for.
+	mapping *Plugin
 }
 
 type result struct {
-	j   job
-	err error
+	j       job
+	err     error
+	retries int
 }
 
 var MissingAwsValuesMessage = "Must set 'bucket'"
 
-func (p *Plugin) Exec() error {
+var sseModes = map[string]bool{
+	"AES256":       true,
+	"aws:kms":      true,
+	"aws:kms:dsse": true,
+	sseCustomer:    true,
+}
+
+func (p *Plugin) Exec(ctx context.Context) error {
 	err := p.sanitizeInputs()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return &ValidationError{err}
+	}
+
+	p.client, err = NewAWS(ctx, p)
+	if err != nil {
+		return &ValidationError{err}
+	}
+	if p.HashCache != "" {
+		p.cache = loadHashCache(p.HashCache)
+	}
+
+	p.summary = newSummary()
+	p.destinations, err = p.newDestinations(ctx)
+	if err != nil {
+		return &ValidationError{err}
+	}
+	if p.PreviewCleanup {
+		return p.cleanupPreviews(ctx)
+	}
+
+	// Every mapping is synchronized with every bucket, each listed on its own.
+	var mappings [][]*Plugin
+	var remotes [][][]object
+	for _, m := range p.forMappings() {
+		dests := p.forDestinations(m)
+		listed := make([][]object, len(dests))
+		for i, d := range dests {
+			listed[i], err = d.listTarget(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		mappings = append(mappings, dests)
+		remotes = append(remotes, listed)
 	}
 
-	p.jobs = make([]job, 1)
-	p.client = NewAWS(p)
+	// The marker is written before any object, so the cleanup finds previews
+	// whose first deployment failed.
+	if p.Preview {
+		if err := p.writePreviewMarkers(ctx); err != nil {
+			return err
+		}
+	}
+
+	if p.Journal != "" && !p.DryRun {
+		p.journal, err = openJournal(p.Journal, p.planHash())
+		if err != nil {
+			logrus.WithError(err).WithField("path", p.Journal).Warn("failed to open journal")
+		}
+	}
 
-	p.createSyncJobs()
-	p.createInvalidateJob()
-	p.runJobs()
+	// Deletes can be held back until every bucket has been synchronized, so
+	// a failing bucket does not leave the others serving a different site.
+	var deletes []job
+	err = p.runJobs(ctx, func(emit func(...job) bool) error {
+		if p.RequireAllDestinations {
+			next := emit
+			emit = func(jobs ...job) bool {
+				if jobs[0].action == "delete" {
+					deletes = append(deletes, jobs...)
+					return true
+				}
+				return next(jobs...)
+			}
+		}
+		for i, dests := range mappings {
+			if err := dests[0].planJobs(ctx, dests, remotes[i], emit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if len(deletes) > 0 {
+		if err != nil {
+			logrus.WithField("deletes", len(deletes)).Warn("skipping deletes as not all buckets were synchronized")
+		} else {
+			err = p.runJobs(ctx, func(emit func(...job) bool) error {
+				for _, j := range deletes {
+					if !emit(j) {
+						break
+					}
+				}
+				return nil
+			})
+		}
+	}
+	err = p.invalidateAfter(ctx, err)
+
+	// The digests are still valid for the files that were processed, even
+	// when other jobs failed.
+	if err := p.journal.close(err == nil); err != nil {
+		logrus.WithError(err).WithField("path", p.Journal).Warn("failed to close journal")
+	}
+	if err := p.cache.save(); err != nil {
+		logrus.WithError(err).WithField("path", p.HashCache).Warn("failed to write hash cache")
+	}
+	p.summary.log()
+	if err := p.writeOutputs(); err != nil {
+		logrus.WithError(err).Warn("failed to export results")
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dests := range mappings {
+		for _, d := range dests {
+			if d.manifest != nil {
+				if err := d.client.WriteManifest(ctx, manifestKey(d.Target), d.manifest); err != nil {
+					return &ManifestError{manifestKey(d.Target), err}
+				}
+			}
+		}
+	}
+
+	if p.Preview {
+		if err := p.writePreviewMarkers(ctx); err != nil {
+			return err
+		}
+	}
+
+	if p.DetailedExitCodes && !p.summary.hasChanges() {
+		return ErrNoChanges
+	}
 	return nil
 }
 
@@ -65,138 +245,598 @@ func (p *Plugin) sanitizeInputs() error {
 		return errors.New(MissingAwsValuesMessage)
 	}
 
+	if p.Compare == "" {
+		p.Compare = compareETag
+	}
+	if !compareModes[p.Compare] {
+		return fmt.Errorf("invalid compare value %q, must be one of %s, %s, %s or %s", p.Compare, compareETag, compareSHA256, compareChecksum, compareSizeMtime)
+	}
+
+	if err := validateSSE(p.SSE, p.SSECustomerKey); err != nil {
+		return err
+	}
+
+	if p.SSECustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(p.SSECustomerKey)
+		if err != nil || len(key) != 32 {
+			return errors.New("'sse-c-key' must be a base64 encoded 256-bit key")
+		}
+	}
+
+	if p.Symlinks == "" {
+		p.Symlinks = symlinksFollow
+	}
+	if !symlinkPolicies[p.Symlinks] {
+		return fmt.Errorf("invalid symlinks value %q, must be one of %s, %s or %s", p.Symlinks, symlinksFollow, symlinksSkip, symlinksError)
+	}
+
+	switch p.UnicodeNormalization {
+	case "", "nfc", "nfd":
+	default:
+		return fmt.Errorf("invalid unicode-normalization value %q, must be nfc or nfd", p.UnicodeNormalization)
+	}
+
+	if p.Preview && p.PreviewCleanup {
+		return errors.New("'preview' and 'preview-cleanup' cannot be combined")
+	}
+
+	if p.Retries < 0 {
+		return errors.New("'retries' must not be negative")
+	}
+	p.retry = retryPolicy{
+		retries:  p.Retries,
+		delay:    p.RetryDelay,
+		maxDelay: p.RetryMaxDelay,
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 	p.Source = filepath.Join(wd, p.Source)
-	p.Target = strings.TrimPrefix(p.Target, "/")
+	p.Target, err = resolveTarget(p.Target)
+	if err != nil {
+		return err
+	}
+	if p.Preview && p.Target == "" {
+		return errors.New("Must set a 'target' below the bucket root for previews")
+	}
+	if err := p.sanitizeMappings(wd); err != nil {
+		return err
+	}
+	if err := p.sanitizeDestinations(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func (p *Plugin) createSyncJobs() {
-	remote, err := p.client.List(p.Target)
+// validateSSE rejects unknown encryption modes and SSE-C without a key.
+func validateSSE(rules map[string]string, customerKey string) error {
+	for pattern, sse := range rules {
+		if !sseModes[sse] {
+			return fmt.Errorf("invalid sse value %q for %q, must be one of AES256, aws:kms, aws:kms:dsse or %s", sse, pattern, sseCustomer)
+		}
+		if sse == sseCustomer && customerKey == "" {
+			return errors.New("Must set 'sse-c-key' when using " + sseCustomer)
+		}
+	}
+	return nil
+}
+
+// resolveTarget expands and normalizes a target.
+func resolveTarget(target string) (string, error) {
+	expanded, err := expandTarget(target)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return "", fmt.Errorf("invalid target template %q: %w", target, err)
 	}
+	return normalizeTarget(expanded)
+}
 
-	local := make([]string, 1)
+// normalizeTarget returns the target as a key prefix without leading or
+// trailing slashes, the empty string being the root of the bucket.
+func normalizeTarget(target string) (string, error) {
+	for _, segment := range strings.Split(target, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid target %q, must not contain .. segments", target)
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+target), "/"), nil
+}
 
-	err = filepath.Walk(p.Source, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
+// targetPrefix returns the prefix of the keys below a normalized target,
+// ending at a directory boundary so a target does not match its siblings.
+func targetPrefix(target string) string {
+	if target == "" {
+		return ""
+	}
+	return target + "/"
+}
+
+// comparesHeaders reports whether uploads need the headers of existing
+// objects because header options have been configured.
+func (p *Plugin) comparesHeaders() bool {
+	return len(p.ContentType) > 0 ||
+		len(p.ContentEncoding) > 0 ||
+		len(p.CacheControl) > 0 ||
+		len(p.Metadata) > 0 ||
+		len(p.SSE) > 0 ||
+		len(p.SSEKMSKeyID) > 0
+}
+
+// listTarget returns the objects below the target, read from the manifest
+// when enabled and listed from the bucket otherwise.
+func (p *Plugin) listTarget(ctx context.Context) ([]object, error) {
+	if p.Manifest {
+		previous, err := p.client.ReadManifest(ctx, manifestKey(p.Target))
+		p.manifest = newManifest(previous, p.Commit)
+		if err == nil {
+			return previous.objects(), nil
 		}
+		logrus.WithError(err).WithField("key", manifestKey(p.Target)).Info("manifest unavailable, listing the target instead")
+	}
+
+	remote, err := p.client.List(ctx, p.Target)
+	if err != nil {
+		return nil, &ListError{p.Target, err}
+	}
+	return remote, nil
+}
+
+// remoteKey returns the key of a local path relative to the source. Keys
+// always use forward slashes, whatever the separator of the platform.
+func (p *Plugin) remoteKey(localPath string) string {
+	key := filepath.ToSlash(localPath)
+	switch p.UnicodeNormalization {
+	case "nfc":
+		key = norm.NFC.String(key)
+	case "nfd":
+		key = norm.NFD.String(key)
+	}
+	return path.Join(p.Target, key)
+}
+
+// errStopped aborts the walk once no more jobs are accepted.
+var errStopped = errors.New("stopped")
+
+// planJobs walks the source of a mapping once and emits the upload and
+// redirect jobs for each of its destinations while walking, grouped by file.
+// Every key seen is removed from the listed sets, so the objects left in them
+// once the walk is complete are the ones to delete. Planning stops early
+// when emit returns false.
+func (p *Plugin) planJobs(ctx context.Context, dests []*Plugin, remotes [][]object, emit func(...job) bool) error {
+	listed := make([]map[string]object, len(dests))
+	for i, remote := range remotes {
+		listed[i] = make(map[string]object, len(remote))
+		for _, r := range remote {
+			listed[i][r.key] = r
+		}
+	}
+
+	seen := 0
+
+	err := p.walkSource(ctx, func(file, localPath string, info os.FileInfo, link string) error {
+		seen++
+		remotePath := p.remoteKey(localPath)
 
-		localPath := path
-		if p.Source != "." {
-			localPath = strings.TrimPrefix(path, p.Source)
-			localPath = strings.TrimPrefix(localPath, "/")
+		group := make([]job, 0, len(dests))
+		for i, d := range dests {
+			r, listedRemote := listed[i][remotePath]
+			delete(listed[i], remotePath)
+
+			if link != "" {
+				group = append(group, job{local: remotePath, remote: "/" + p.remoteKey(link), action: "redirect", mapping: d})
+				continue
+			}
+
+			// Comparing size and modification time only needs the listing, so
+			// unchanged files are skipped without a request or reading them.
+			// With a manifest every file is recorded by its upload job instead,
+			// and with header or access rules the upload job checks the object.
+			if p.Compare == compareSizeMtime && d.manifest == nil && !d.comparesHeaders() && len(d.Access) == 0 {
+				if listedRemote && sizeMtimeMatches(r.size, r.lastModified, info) {
+					logrus.WithFields(logrus.Fields{
+						"bucket": d.Bucket,
+						"key":    remotePath,
+						"action": outcomeSkipped,
+						"bytes":  info.Size(),
+						"reason": "size and modification time match",
+					}).Debug(outcomeSkipped)
+					d.summary.add(remotePath, outcomeSkipped, info.Size(), 0)
+					continue
+				}
+			}
+
+			j := job{
+				local:   file,
+				remote:  remotePath,
+				action:  "upload",
+				size:    info.Size(),
+				mtime:   info.ModTime().UnixNano(),
+				info:    info,
+				mapping: d,
+			}
+			if listedRemote {
+				j.object = &r
+			}
+			group = append(group, j)
 		}
-		local = append(local, localPath)
-		p.jobs = append(p.jobs, job{
-			local:  filepath.Join(p.Source, localPath),
-			remote: filepath.Join(p.Target, localPath),
-			action: "upload",
-		})
 
+		if len(group) > 0 && !emit(group...) {
+			return errStopped
+		}
 		return nil
 	})
+	if errors.Is(err, errStopped) {
+		return nil
+	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 
 	for path, location := range p.Redirects {
 		path = strings.TrimPrefix(path, "/")
-		local = append(local, path)
-		p.jobs = append(p.jobs, job{
-			local:  path,
-			remote: location,
-			action: "redirect",
-		})
-	}
-	if p.Delete {
-		for _, r := range remote {
-			found := false
-			rPath := strings.TrimPrefix(r, p.Target+"/")
-			for _, l := range local {
-				if l == rPath {
-					found = true
-					break
-				}
-			}
+		group := make([]job, 0, len(dests))
+		for i, d := range dests {
+			delete(listed[i], path)
+			group = append(group, job{local: path, remote: location, action: "redirect", mapping: d})
+		}
+		if !emit(group...) {
+			return nil
+		}
+	}
+	if !p.Delete {
+		return nil
+	}
+
+	// An empty source usually means the build failed to produce output, so
+	// the target is not wiped out. Only files walked from the source count,
+	// not the configured redirects.
+	for i, d := range dests {
+		if seen == 0 && len(remotes[i]) > 0 {
+			return &SafetyError{fmt.Sprintf("source %s is empty, refusing to delete %d objects in %s", p.Source, len(remotes[i]), d.Bucket)}
+		}
+	}
 
-			if !found {
-				p.jobs = append(p.jobs, job{
-					local:  "",
-					remote: r,
-					action: "delete",
-				})
+	for i, d := range dests {
+		delete(listed[i], manifestKey(p.Target))
+		delete(listed[i], previewMarkerKey(p.Target))
+		for _, r := range remotes[i] {
+			if _, unseen := listed[i][r.key]; !unseen {
+				continue
+			}
+			if !emit(job{remote: r.key, action: "delete", size: r.size, mapping: d}) {
+				return nil
 			}
 		}
 	}
+
+	return nil
 }
 
-func (p *Plugin) createInvalidateJob() {
-	if len(p.CloudFrontDistribution) > 0 {
-		p.jobs = append(p.jobs, job{
-			local:  "",
-			remote: filepath.Join("/", p.Target, "*"),
-			action: "invalidateCloudFront",
-		})
+// runJobs runs the jobs emitted by plan as they are planned. Files are hashed
+// by a pool sized to the CPUs and the requests are sent by a separate pool
+// sized by max-concurrency. The queues between them are bounded, so uploads
+// start while the source is still being walked and memory does not grow with
+// the site.
+func (p *Plugin) runJobs(ctx context.Context, plan func(emit func(...job) bool) error) error {
+	workers := max(p.MaxConcurrency, 1)
+	hashers := p.hashers()
+	limit := newLimiter(p.InitialConcurrency, p.MaxConcurrency, p.AdaptiveConcurrency)
+	hashQueue := make(chan []job, hashers)
+	queue := make(chan job, workers)
+	var failed atomic.Bool
+
+	// Requests in flight get a grace period to finish once the run has been
+	// cancelled, while no new jobs are started.
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+	stop := context.AfterFunc(ctx, func() {
+		logrus.WithField("grace_period", p.GracePeriod.String()).Warn("cancelled, waiting for jobs in flight")
+		time.AfterFunc(p.GracePeriod, cancelJobs)
+	})
+	defer stop()
+
+	buckets := make([]string, 0, len(p.destinations))
+	for _, d := range p.destinations {
+		buckets = append(buckets, d.Bucket)
 	}
-}
+	logrus.WithField("bucket", strings.Join(buckets, ",")).Info("synchronizing")
+	progress := p.startProgress()
+	defer progress.stop()
 
-func (p *Plugin) runJobs() {
-	client := p.client
-	jobChan := make(chan struct{}, p.MaxConcurrency)
-	results := make(chan *result, len(p.jobs))
-	var invalidateJob *job
+	var mu sync.Mutex
+	var failures []*result
+	var unprocessed []string
+	var started, planned atomic.Int64
 
-	fmt.Printf("Synchronizing with bucket \"%s\"\n", p.Bucket)
-	for _, j := range p.jobs {
-		jobChan <- struct{}{}
-		go func(j job) {
-			var err error
-			if j.action == "upload" {
-				err = client.Upload(j.local, j.remote)
-			} else if j.action == "redirect" {
-				err = client.Redirect(j.local, j.remote)
-			} else if j.action == "delete" {
-				err = client.Delete(j.remote)
-			} else if j.action == "invalidateCloudFront" {
-				invalidateJob = &j
-			} else {
-				err = nil
+	finish := func(r *result) {
+		progress.done()
+		if r.err != nil {
+			failed.Store(true)
+			r.err = jobError(r.j, r.retries, r.err)
+			mu.Lock()
+			failures = append(failures, r)
+			mu.Unlock()
+		}
+	}
+
+	// A file is hashed once for the jobs of all destinations. Jobs are
+	// passed on without hashing once the run has been stopped, so the
+	// workers account for them.
+	var hashWG sync.WaitGroup
+	for range hashers {
+		hashWG.Add(1)
+		go func() {
+			defer hashWG.Done()
+			for group := range hashQueue {
+				if ctx.Err() == nil && (!failed.Load() || p.ContinueOnError) {
+					if err := p.hashGroup(group); err != nil {
+						for _, j := range group {
+							j.mapping.summary.add(j.remote, outcomeFailed, j.size, 0)
+							logJob(j, outcomeFailed, "", 0, 0, err)
+							finish(&result{j, err, 0})
+						}
+						continue
+					}
+				}
+				for _, j := range group {
+					queue <- j
+				}
 			}
-			results <- &result{j, err}
-			<-jobChan
-		}(j)
+		}()
 	}
 
-	for range p.jobs {
-		r := <-results
-		if r.err != nil {
-			fmt.Printf("ERROR: failed to %s %s to %s: %+v\n", r.j.action, r.j.local, r.j.remote, r.err)
-			os.Exit(1)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if ctx.Err() != nil {
+					mu.Lock()
+					unprocessed = append(unprocessed, j.remote)
+					mu.Unlock()
+					continue
+				}
+				if failed.Load() && !p.ContinueOnError {
+					continue
+				}
+
+				started.Add(1)
+				finish(p.runJob(ctx, jobCtx, j, limit))
+			}
+		}()
+	}
+
+	err := plan(func(jobs ...job) bool {
+		if failed.Load() && !p.ContinueOnError {
+			return false
+		}
+		group := make([]job, 0, len(jobs))
+		for _, j := range jobs {
+			if p.journal.done(j) {
+				j.mapping.summary.add(j.remote, outcomeSkipped, j.size, 0)
+				logJob(j, outcomeSkipped, "completed by a previous run", 0, 0, nil)
+				continue
+			}
+			group = append(group, j)
+		}
+		if len(group) == 0 {
+			return true
 		}
+		select {
+		case hashQueue <- group:
+			planned.Add(int64(len(group)))
+			for range group {
+				progress.planned()
+			}
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+
+	// Jobs already in flight are waited for even after a failure, so no
+	// request is abandoned halfway.
+	close(hashQueue)
+	hashWG.Wait()
+	close(queue)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return p.cancelled(ctx, failures, unprocessed)
+	}
+	if err != nil {
+		return err
 	}
 
-	if invalidateJob != nil {
-		err := client.Invalidate(invalidateJob.remote)
-		if err != nil {
-			fmt.Printf("ERROR: failed to %s %s to %s: %+v\n", invalidateJob.action, invalidateJob.local, invalidateJob.remote, err)
-			os.Exit(1)
+	if len(failures) > 0 && !p.ContinueOnError {
+		logrus.WithFields(logrus.Fields{
+			"started": started.Load(),
+			"jobs":    planned.Load(),
+		}).Error("stopped after the first failure")
+		return failures[0].err
+	}
+
+	if len(failures) > 0 {
+		reportFailures(failures)
+		errs := make([]error, 0, len(failures))
+		for _, r := range failures {
+			errs = append(errs, r.err)
 		}
+		return &JobsError{errs}
 	}
+
+	return nil
 }
 
-func debug(format string, args ...interface{}) {
-	if os.Getenv("DEBUG") != "" {
-		fmt.Printf(format+"\n", args...)
+// runJob runs a single job with retries, holding a slot of the limiter for
+// its whole duration.
+func (p *Plugin) runJob(ctx, jobCtx context.Context, j job, limit *limiter) *result {
+	client := j.mapping.client
+
+	limit.acquire()
+	defer limit.release()
+
+	var outcome, reason string
+	begin := time.Now()
+	retries, err := p.retry.do(ctx, func() error {
+		var err error
+		start := time.Now()
+		switch j.action {
+		case "upload":
+			outcome, reason, err = client.Upload(jobCtx, j)
+		case "redirect":
+			outcome, err = outcomeRedirected, client.Redirect(jobCtx, j.local, j.remote)
+		case "delete":
+			outcome, err = outcomeDeleted, client.Delete(jobCtx, j.remote)
+		}
+		limit.observe(err, time.Since(start))
+		return err
+	})
+	if err != nil {
+		outcome = outcomeFailed
 	} else {
-		fmt.Printf(".")
+		p.journal.record(j)
+	}
+	j.mapping.summary.add(j.remote, outcome, j.size, retries)
+	logJob(j, outcome, reason, retries, time.Since(begin), err)
+
+	return &result{j, err, retries}
+}
+
+// hashers returns the number of files hashed concurrently.
+func (p *Plugin) hashers() int {
+	if p.HashConcurrency < 1 {
+		return runtime.NumCPU()
+	}
+	return p.HashConcurrency
+}
+
+// bufferSize returns the size up to which hashed files are kept in memory.
+// A hashed job is held by a hasher, the queue or a worker until it is
+// uploaded, so the budget is shared by all of them.
+func (p *Plugin) bufferSize() int64 {
+	holders := 2*max(p.MaxConcurrency, 1) + p.hashers()
+	return min(maxBufferSize, bufferBudget/int64(holders))
+}
+
+// hashJob computes the digests of the file of an upload job. Small files are
+// kept in memory along with their digests, so the upload does not read them
+// again.
+func (p *Plugin) hashJob(j job) (job, error) {
+	if j.action != "upload" || p.Compare == compareSizeMtime {
+		return j, nil
+	}
+
+	file, err := os.Open(j.local)
+	if err != nil {
+		return j, err
+	}
+	defer file.Close()
+
+	j.sums, j.body, err = p.cache.digests(j.local, file, j.info, p.Compare, p.bufferSize())
+	return j, err
+}
+
+// hashGroup hashes the file shared by a group of jobs once for all of them.
+func (p *Plugin) hashGroup(group []job) error {
+	hashed, err := p.hashJob(group[0])
+	if err != nil {
+		return err
+	}
+	for i := range group {
+		group[i].sums, group[i].body = hashed.sums, hashed.body
+	}
+	return nil
+}
+
+// cancelled reports the objects that were not processed because the run was
+// cancelled, either before their job started or while it was in flight.
+// Files the walk had not reached yet are not known and not reported.
+func (p *Plugin) cancelled(ctx context.Context, failures []*result, queued []string) error {
+	var unprocessed []string
+	for _, r := range failures {
+		if errors.Is(r.err, context.Canceled) || errors.Is(r.err, context.DeadlineExceeded) {
+			unprocessed = append(unprocessed, r.j.remote)
+		}
+	}
+	interrupted := len(unprocessed)
+	unprocessed = append(unprocessed, queued...)
+
+	p.summary.setUnprocessed(len(unprocessed))
+	logrus.WithFields(logrus.Fields{
+		"interrupted": interrupted,
+		"unprocessed": len(unprocessed),
+		"keys":        unprocessed,
+	}).Warn("run cancelled")
+
+	return &CancelledError{Err: ctx.Err(), Unprocessed: unprocessed}
+}
+
+// reportFailures logs the failed jobs grouped by action and error code.
+func reportFailures(failures []*result) {
+	type group struct{ action, code string }
+	groups := map[group][]string{}
+	for _, r := range failures {
+		g := group{r.j.action, errorCode(r.err)}
+		groups[g] = append(groups[g], r.j.remote)
+	}
+
+	keys := slices.SortedFunc(maps.Keys(groups), func(a, b group) int {
+		return cmp.Or(cmp.Compare(a.action, b.action), cmp.Compare(a.code, b.code))
+	})
+
+	logrus.WithField("failed", len(failures)).Error("jobs failed")
+	for _, g := range keys {
+		logrus.WithFields(logrus.Fields{
+			"action": g.action,
+			"code":   g.code,
+			"count":  len(groups[g]),
+			"keys":   groups[g],
+		}).Error("failed jobs")
+	}
+}
+
+// logJob logs the outcome of a finished job. Skipped objects are only logged
+// at debug level to keep the output of large sites readable.
+func logJob(j job, outcome, reason string, retries int, took time.Duration, err error) {
+	entry := logrus.WithFields(logrus.Fields{
+		"key":      j.remote,
+		"action":   outcome,
+		"bytes":    j.size,
+		"duration": took.Round(time.Millisecond).String(),
+	})
+	if reason != "" {
+		entry = entry.WithField("reason", reason)
+	}
+	if j.mapping != nil && len(j.mapping.Destinations) > 0 {
+		entry = entry.WithField("bucket", j.mapping.Bucket)
+	}
+	if retries > 0 {
+		entry = entry.WithField("retries", retries)
+	}
+
+	switch {
+	case err != nil:
+		entry.WithError(err).Error(j.action + " failed")
+	case outcome == outcomeSkipped:
+		entry.Debug(outcome)
+	default:
+		entry.Info(outcome)
+	}
+}
+
+// errorCode returns the service error code of err, or a generic code for
+// errors that did not come from the service.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	if retryable(err) {
+		return "NetworkError"
 	}
+	return "LocalError"
 }
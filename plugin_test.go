@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+		prefix string
+		err    bool
+	}{
+		{target: "", want: "", prefix: ""},
+		{target: "/", want: "", prefix: ""},
+		{target: ".", want: "", prefix: ""},
+		{target: "docs", want: "docs", prefix: "docs/"},
+		{target: "/docs/", want: "docs", prefix: "docs/"},
+		{target: "docs//a", want: "docs/a", prefix: "docs/a/"},
+		{target: "..", err: true},
+		{target: "a/../b", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeTarget(tt.target)
+		if tt.err {
+			if err == nil {
+				t.Errorf("normalizeTarget(%q) = %q, want an error", tt.target, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeTarget(%q) returned error %v", tt.target, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeTarget(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+		if prefix := targetPrefix(got); prefix != tt.prefix {
+			t.Errorf("targetPrefix(%q) = %q, want %q", got, prefix, tt.prefix)
+		}
+	}
+}
+
+func TestTargetPrefixMatching(t *testing.T) {
+	tests := []struct {
+		target string
+		key    string
+		want   bool
+	}{
+		{target: "docs", key: "docs/index.html", want: true},
+		{target: "docs", key: "docs-old/index.html", want: false},
+		{target: "docs", key: "docs", want: false},
+		{target: "docs-old", key: "docs-old/index.html", want: true},
+		{target: "", key: "docs-old/index.html", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := strings.HasPrefix(tt.key, targetPrefix(tt.target)); got != tt.want {
+			t.Errorf("key %q below target %q = %v, want %v", tt.key, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPlanJobsEmptySource(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     []string
+		redirects map[string]string
+		safety    bool
+	}{
+		{name: "empty source", safety: true},
+		{name: "empty source with redirects", redirects: map[string]string{"old.html": "/new.html"}, safety: true},
+		{name: "source with files", files: []string{"index.html"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(source, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := &Plugin{
+				Source:    source,
+				Target:    "site",
+				Delete:    true,
+				Redirects: tt.redirects,
+				Compare:   compareETag,
+				Symlinks:  symlinksFollow,
+				summary:   newSummary(),
+			}
+			remote := []object{{key: "site/index.html"}, {key: "site/about.html"}}
+
+			var deletes int
+			err := p.planJobs(context.Background(), []*Plugin{p}, [][]object{remote}, func(jobs ...job) bool {
+				for _, j := range jobs {
+					if j.action == "delete" {
+						deletes++
+					}
+				}
+				return true
+			})
+
+			var safetyErr *SafetyError
+			if got := errors.As(err, &safetyErr); got != tt.safety {
+				t.Fatalf("planJobs() error = %v, want a safety error %v", err, tt.safety)
+			}
+			if tt.safety && deletes > 0 {
+				t.Errorf("planned %d deletes despite the safety error", deletes)
+			}
+		})
+	}
+}
+
+// BenchmarkPlanDeletes plans a target of 100k listed keys, half of them
+// matching the files walked and half of them to delete, so a regression to
+// comparing every listed key with every file shows.
+func BenchmarkPlanDeletes(b *testing.B) {
+	const dirs, files = 100, 500
+
+	source := b.TempDir()
+	remote := make([]object, 0, 2*dirs*files)
+	for d := range dirs {
+		dir := filepath.Join(source, fmt.Sprintf("dir%03d", d))
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for f := range files {
+			name := fmt.Sprintf("file%03d.html", f)
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+				b.Fatal(err)
+			}
+			remote = append(remote,
+				object{key: fmt.Sprintf("site/dir%03d/%s", d, name)},
+				object{key: fmt.Sprintf("site/stale%03d/%s", d, name)},
+			)
+		}
+	}
+
+	p := &Plugin{
+		Source:   source,
+		Target:   "site",
+		Delete:   true,
+		Compare:  compareETag,
+		Symlinks: symlinksFollow,
+		summary:  newSummary(),
+	}
+	ctx := context.Background()
+
+	for b.Loop() {
+		var uploads, deletes int
+		err := p.planJobs(ctx, []*Plugin{p}, [][]object{remote}, func(jobs ...job) bool {
+			for _, j := range jobs {
+				switch j.action {
+				case "upload":
+					uploads++
+				case "delete":
+					deletes++
+				}
+			}
+			return true
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if uploads != dirs*files || deletes != dirs*files {
+			b.Fatalf("planned %d uploads and %d deletes, want %d of each", uploads, deletes, dirs*files)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const previewMarkerName = ".s3sync-preview.json"
+
+// previewMarker is written to the prefix of every preview deployment, so the
+// cleanup can decide whether the preview is still needed.
+type previewMarker struct {
+	PullRequest string    `json:"pull_request,omitempty"`
+	Branch      string    `json:"branch,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// previewMarkerKey returns the key of the marker for the preview prefix.
+func previewMarkerKey(target string) string {
+	return path.Join(target, previewMarkerName)
+}
+
+func newPreviewMarker() previewMarker {
+	return previewMarker{
+		PullRequest: os.Getenv("DRONE_PULL_REQUEST"),
+		Branch:      cmp.Or(os.Getenv("DRONE_SOURCE_BRANCH"), os.Getenv("DRONE_BRANCH")),
+		Commit:      os.Getenv("DRONE_COMMIT_SHA"),
+		Updated:     time.Now().UTC(),
+	}
+}
+
+// writePreviewMarkers writes the marker of the preview to every bucket,
+// updating the time of its last deployment.
+func (p *Plugin) writePreviewMarkers(ctx context.Context) error {
+	for _, d := range p.destinations {
+		if err := d.client.WritePreviewMarker(ctx, previewMarkerKey(p.Target), newPreviewMarker()); err != nil {
+			return &PreviewError{p.Target, err}
+		}
+	}
+	return nil
+}
+
+// closedPullRequests returns the pull requests whose previews are removed
+// regardless of their age, including the pull request of a build triggered
+// by closing it.
+func (p *Plugin) closedPullRequests() map[string]bool {
+	closed := map[string]bool{}
+	for _, pr := range p.PreviewClosed {
+		if pr = strings.TrimSpace(pr); pr != "" {
+			closed[pr] = true
+		}
+	}
+	if pr := os.Getenv("DRONE_PULL_REQUEST"); pr != "" && os.Getenv("DRONE_BUILD_ACTION") == "close" {
+		closed[pr] = true
+	}
+	return closed
+}
+
+// cleanupPreviews deletes the previews below the target whose pull request
+// is closed or which have not been updated within the maximum age. A marker
+// is only deleted once all objects of its preview are, so a failed cleanup
+// is picked up again by the next run.
+func (p *Plugin) cleanupPreviews(ctx context.Context) error {
+	closed := p.closedPullRequests()
+	remotes := make([][]object, len(p.destinations))
+	expired := make([]map[string]object, len(p.destinations))
+	for i, d := range p.destinations {
+		remote, err := d.client.List(ctx, p.Target)
+		if err != nil {
+			return &ListError{p.Target, err}
+		}
+		remotes[i] = remote
+		expired[i] = d.expiredPreviews(ctx, remote, closed)
+	}
+
+	err := p.runJobs(ctx, func(emit func(...job) bool) error {
+		for i, d := range p.destinations {
+			for _, r := range remotes[i] {
+				if path.Base(r.key) == previewMarkerName || !inPreview(r.key, expired[i]) {
+					continue
+				}
+				if !emit(job{remote: r.key, action: "delete", size: r.size, mapping: d}) {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+
+	if err == nil {
+	markers:
+		for i, d := range p.destinations {
+			for _, marker := range expired[i] {
+				retries, derr := p.retry.do(ctx, func() error {
+					return d.client.Delete(ctx, marker.key)
+				})
+				if derr != nil {
+					err = jobError(job{remote: marker.key, action: "delete"}, retries, derr)
+					break markers
+				}
+				d.summary.add(marker.key, outcomeDeleted, marker.size, retries)
+			}
+		}
+	}
+	err = p.invalidateAfter(ctx, err)
+
+	p.summary.log()
+	if err := p.writeOutputs(); err != nil {
+		logrus.WithError(err).Warn("failed to export results")
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.DetailedExitCodes && !p.summary.hasChanges() {
+		return ErrNoChanges
+	}
+	return nil
+}
+
+// expiredPreviews returns the markers of the previews to delete by their
+// prefix.
+func (p *Plugin) expiredPreviews(ctx context.Context, remote []object, closed map[string]bool) map[string]object {
+	expired := map[string]object{}
+	for _, r := range remote {
+		if path.Base(r.key) != previewMarkerName {
+			continue
+		}
+		prefix := path.Dir(r.key)
+		if prefix == "." || prefix == p.Target {
+			continue
+		}
+
+		marker, err := p.client.ReadPreviewMarker(ctx, r.key)
+		if err != nil {
+			logrus.WithError(err).WithField("key", r.key).Warn("ignoring unreadable preview marker")
+			continue
+		}
+
+		var reason string
+		switch {
+		case marker.PullRequest != "" && closed[marker.PullRequest]:
+			reason = "pull request closed"
+		case p.PreviewMaxAge > 0 && time.Since(marker.Updated) > p.PreviewMaxAge:
+			reason = fmt.Sprintf("not updated for more than %s", p.PreviewMaxAge)
+		default:
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"bucket":       p.Bucket,
+			"prefix":       prefix,
+			"pull_request": marker.PullRequest,
+			"updated":      marker.Updated,
+			"reason":       reason,
+		}).Info("removing preview")
+		expired[prefix] = r
+	}
+	return expired
+}
+
+// inPreview reports whether key is below one of the preview prefixes.
+func inPreview(key string, previews map[string]object) bool {
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := previews[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+)
+
+// retryableCodes are error codes of transient failures worth retrying.
+var retryableCodes = map[string]bool{
+	"InternalError":              true,
+	"ServiceUnavailable":         true,
+	"SlowDown":                   true,
+	"Throttling":                 true,
+	"ThrottlingException":        true,
+	"RequestTimeout":             true,
+	"RequestTimeoutException":    true,
+	"OperationAborted":           true,
+	"XMinioServerNotInitialized": true,
+}
+
+// retryableStatuses are HTTP statuses of transient failures worth retrying.
+// Other server errors like 501 Not Implemented fail the same way every time.
+var retryableStatuses = map[int]bool{
+	429: true,
+	500: true,
+	502: true,
+	503: true,
+	504: true,
+}
+
+// retryPolicy retries jobs failing with transient errors using exponential
+// backoff with full jitter.
+type retryPolicy struct {
+	retries  int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// do calls fn until it succeeds, fails with an error that is not retryable,
+// the retries are used up or ctx is cancelled. It returns the number of
+// retries made.
+func (r retryPolicy) do(ctx context.Context, fn func() error) (int, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= r.retries || !retryable(err) {
+			return attempt, err
+		}
+
+		wait := r.backoff(attempt)
+		logrus.WithError(err).WithField("delay", wait.String()).Debug("retrying")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random delay up to the exponentially growing ceiling for
+// the attempt.
+func (r retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := r.maxDelay
+	if attempt < 32 {
+		if d := r.delay << attempt; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling) + 1
+}
+
+// retryable reports whether err is a transient failure, as opposed to a
+// fatal one such as missing permissions or an unknown bucket.
+func retryable(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && retryableCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return retryableStatuses[respErr.HTTPStatusCode()]
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
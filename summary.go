@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Outcomes of the jobs counted in the summary.
+const (
+	outcomeCreated    = "created"
+	outcomeUpdated    = "updated content"
+	outcomeMetadata   = "updated metadata"
+	outcomeSkipped    = "skipped"
+	outcomeRedirected = "redirected"
+	outcomeDeleted    = "deleted"
+	outcomeFailed     = "failed"
+)
+
+var outcomes = []string{
+	outcomeCreated,
+	outcomeUpdated,
+	outcomeMetadata,
+	outcomeSkipped,
+	outcomeRedirected,
+	outcomeDeleted,
+	outcomeFailed,
+}
+
+// summary collects the totals of a run. With several buckets the totals of
+// each bucket are collected by a child summary adding to its parent.
+type summary struct {
+	mu             sync.Mutex
+	parent         *summary
+	bucket         string
+	buckets        []*summary
+	started        time.Time
+	counts         map[string]int
+	bytes          map[string]int64
+	retries        int
+	invalidation   string
+	invalidationID string
+	changed        []string
+	unprocessed    int
+}
+
+func newSummary() *summary {
+	return &summary{
+		started: time.Now(),
+		counts:  map[string]int{},
+		bytes:   map[string]int64{},
+	}
+}
+
+// child returns the summary of a bucket.
+func (s *summary) child(bucket string) *summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.buckets {
+		if b.bucket == bucket {
+			return b
+		}
+	}
+
+	b := newSummary()
+	b.parent = s
+	b.bucket = bucket
+	s.buckets = append(s.buckets, b)
+	return b
+}
+
+// setInvalidation records the status and id of the CloudFront invalidation.
+func (s *summary) setInvalidation(status, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidation = status
+	s.invalidationID = id
+}
+
+// addRetries counts retried requests that do not belong to a job.
+func (s *summary) addRetries(retries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries += retries
+}
+
+// setUnprocessed records the number of objects left unprocessed by a
+// cancelled run.
+func (s *summary) setUnprocessed(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unprocessed = n
+}
+
+// add counts a finished job.
+func (s *summary) add(key, outcome string, size int64, retries int) {
+	s.mu.Lock()
+	s.counts[outcome]++
+	s.bytes[outcome] += size
+	s.retries += retries
+	if outcome != outcomeSkipped && outcome != outcomeFailed {
+		s.changed = append(s.changed, key)
+	}
+	s.mu.Unlock()
+
+	if s.parent != nil {
+		s.parent.add(key, outcome, size, retries)
+	}
+}
+
+// hasChanges reports whether the run modified the bucket.
+func (s *summary) hasChanges() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.changed) > 0
+}
+
+// log writes the totals of the run as a single entry, followed by one entry
+// per bucket when several buckets were synchronized.
+func (s *summary) log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := s.totals()
+	invalidation := s.invalidation
+	if invalidation == "" {
+		invalidation = "none"
+	}
+	if s.unprocessed > 0 {
+		fields["unprocessed"] = s.unprocessed
+	}
+	fields["invalidation"] = invalidation
+	if s.invalidationID != "" {
+		fields["invalidation_id"] = s.invalidationID
+	}
+	fields["duration"] = time.Since(s.started).Round(time.Millisecond).String()
+
+	logrus.WithFields(fields).Info("summary")
+
+	for _, b := range s.buckets {
+		b.mu.Lock()
+		fields := b.totals()
+		b.mu.Unlock()
+		fields["bucket"] = b.bucket
+		logrus.WithFields(fields).Info("bucket summary")
+	}
+}
+
+func (s *summary) totals() logrus.Fields {
+	fields := logrus.Fields{}
+	for _, outcome := range outcomes {
+		name := strings.ReplaceAll(outcome, " ", "_")
+		fields[name] = s.counts[outcome]
+		fields[name+"_bytes"] = s.bytes[outcome]
+	}
+	fields["retries"] = s.retries
+	return fields
+}
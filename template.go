@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// targetVars are the build variables available to target templates.
+type targetVars struct {
+	Branch      string
+	PullRequest string
+	Commit      string
+	Tag         string
+	BuildNumber string
+	Env         map[string]string
+}
+
+var slugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+var targetFuncs = template.FuncMap{
+	// slug turns a value like a branch name into a single path segment.
+	"slug": func(s string) string {
+		return strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	},
+	// truncate keeps the first n characters, never splitting a character
+	// encoded in several bytes.
+	"truncate": func(n int, s string) string {
+		if r := []rune(s); len(r) > n {
+			return string(r[:n])
+		}
+		return s
+	},
+	"lower": strings.ToLower,
+	"env":   os.Getenv,
+}
+
+// expandTarget expands a target template like previews/{{ .Branch | slug }}
+// with the variables of the build. Targets without template actions are
+// returned unchanged.
+func expandTarget(target string) (string, error) {
+	if !strings.Contains(target, "{{") {
+		return target, nil
+	}
+
+	tmpl, err := template.New("target").Funcs(targetFuncs).Option("missingkey=error").Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	vars := targetVars{
+		Branch:      os.Getenv("DRONE_BRANCH"),
+		PullRequest: os.Getenv("DRONE_PULL_REQUEST"),
+		Commit:      os.Getenv("DRONE_COMMIT_SHA"),
+		Tag:         os.Getenv("DRONE_TAG"),
+		BuildNumber: os.Getenv("DRONE_BUILD_NUMBER"),
+		Env:         map[string]string{},
+	}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			vars.Env[k] = v
+		}
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+
+	// An action expanding to nothing would move the target up to its parent,
+	// and deleting would then remove the targets next to it. Only slashes the
+	// template itself starts or ends with may be left out.
+	expanded := b.String()
+	if strings.HasPrefix(target, "/") {
+		expanded = strings.TrimPrefix(expanded, "/")
+	}
+	if strings.HasSuffix(target, "/") {
+		expanded = strings.TrimSuffix(expanded, "/")
+	}
+	for _, segment := range strings.Split(expanded, "/") {
+		if segment == "" || segment == "." {
+			return "", fmt.Errorf("expands to %q with an empty path segment", b.String())
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestExpandTargetEmptySegment(t *testing.T) {
+	tests := []struct {
+		target string
+		branch string
+		want   string
+		err    bool
+	}{
+		{target: "previews/{{ .Branch | slug }}", branch: "feature/x", want: "previews/feature-x"},
+		{target: "/previews/{{ .Branch | slug }}/", branch: "feature/x", want: "/previews/feature-x/"},
+		{target: "previews/{{ .Branch | slug }}", branch: "", err: true},
+		{target: "previews/{{ .Branch | slug }}/", branch: "///", err: true},
+		{target: "{{ .Branch | slug }}/site", branch: "", err: true},
+		{target: "{{ .Branch | slug }}", branch: "", err: true},
+		{target: "previews/{{ .Branch }}", branch: ".", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DRONE_BRANCH", tt.branch)
+		got, err := expandTarget(tt.target)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expandTarget(%q) with branch %q = %q, want an error", tt.target, tt.branch, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandTarget(%q) with branch %q returned error %v", tt.target, tt.branch, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandTarget(%q) with branch %q = %q, want %q", tt.target, tt.branch, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	truncate := targetFuncs["truncate"].(func(int, string) string)
+
+	tests := []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{n: 3, s: "feature", want: "fea"},
+		{n: 10, s: "feature", want: "feature"},
+		{n: 2, s: "über", want: "üb"},
+		{n: 1, s: "日本語", want: "日"},
+	}
+
+	for _, tt := range tests {
+		if got := truncate(tt.n, tt.s); got != tt.want {
+			t.Errorf("truncate(%d, %q) = %q, want %q", tt.n, tt.s, got, tt.want)
+		}
+	}
+}
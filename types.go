@@ -69,3 +69,67 @@ func (m *MapFlag) Set(value string) error {
 	m.parts = map[string]string{}
 	return json.Unmarshal([]byte(value), &m.parts)
 }
+
+// Mapping synchronizes a source directory with a target prefix. Rules left
+// unset are taken from the top-level settings, except for redirects which are
+// only set on mappings.
+type Mapping struct {
+	Source          string                       `json:"source"`
+	Target          string                       `json:"target"`
+	Delete          *bool                        `json:"delete"`
+	Access          map[string]string            `json:"access"`
+	CacheControl    map[string]string            `json:"cache_control"`
+	ContentType     map[string]string            `json:"content_type"`
+	ContentEncoding map[string]string            `json:"content_encoding"`
+	Metadata        map[string]map[string]string `json:"metadata"`
+	Redirects       map[string]string            `json:"redirects"`
+	SSE             map[string]string            `json:"sse"`
+	SSEKMSKeyID     map[string]string            `json:"sse_kms_key_id"`
+}
+
+type MappingsFlag struct {
+	parts []Mapping
+}
+
+func (m *MappingsFlag) String() string {
+	return ""
+}
+
+func (m *MappingsFlag) Get() []Mapping {
+	return m.parts
+}
+
+func (m *MappingsFlag) Set(value string) error {
+	m.parts = []Mapping{}
+	return json.Unmarshal([]byte(value), &m.parts)
+}
+
+// Destination is a bucket synchronized in addition to the top-level bucket.
+// The region, endpoint, credentials and path style are taken from the
+// top-level settings when left unset.
+type Destination struct {
+	Bucket                 string `json:"bucket"`
+	Region                 string `json:"region"`
+	Endpoint               string `json:"endpoint"`
+	AccessKey              string `json:"access_key"`
+	SecretKey              string `json:"secret_key"`
+	PathStyle              *bool  `json:"path_style"`
+	CloudFrontDistribution string `json:"cloudfront_distribution"`
+}
+
+type DestinationsFlag struct {
+	parts []Destination
+}
+
+func (d *DestinationsFlag) String() string {
+	return ""
+}
+
+func (d *DestinationsFlag) Get() []Destination {
+	return d.parts
+}
+
+func (d *DestinationsFlag) Set(value string) error {
+	d.parts = []Destination{}
+	return json.Unmarshal([]byte(value), &d.parts)
+}
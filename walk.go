@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Policies for symbolic links found in the source.
+const (
+	symlinksFollow = "follow"
+	symlinksSkip   = "skip"
+	symlinksError  = "error"
+)
+
+var symlinkPolicies = map[string]bool{
+	symlinksFollow: true,
+	symlinksSkip:   true,
+	symlinksError:  true,
+}
+
+// walkFunc is called for every file of the source with its path, its path
+// relative to the source and its info. For symbolic links turned into
+// redirects, link is the path of the linked file relative to the source.
+type walkFunc func(file, rel string, info os.FileInfo, link string) error
+
+// walkSource walks the files of the source in lexical order, handling
+// symbolic links according to the symlinks policy.
+func (p *Plugin) walkSource(ctx context.Context, fn walkFunc) error {
+	real, err := filepath.EvalSymlinks(p.Source)
+	if err != nil {
+		return &WalkError{p.Source, err}
+	}
+	return p.walkDir(ctx, p.Source, "", []string{real}, fn)
+}
+
+// walkDir walks dir, whose real path is the last of ancestors. The real paths
+// of the directories above are kept to detect links looping back to them.
+func (p *Plugin) walkDir(ctx context.Context, dir, rel string, ancestors []string, fn walkFunc) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return &WalkError{dir, err}
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return &CancelledError{Err: ctx.Err()}
+		}
+
+		file := filepath.Join(dir, entry.Name())
+		fileRel := filepath.Join(rel, entry.Name())
+		real := filepath.Join(ancestors[len(ancestors)-1], entry.Name())
+
+		info, err := os.Lstat(file)
+		if err != nil {
+			return &WalkError{file, err}
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, ok := p.symlinkRedirect(file); ok {
+				if err := fn(file, fileRel, info, link); err != nil {
+					return err
+				}
+				continue
+			}
+
+			switch p.Symlinks {
+			case symlinksSkip:
+				logrus.WithField("path", file).Debug("skipping symbolic link")
+				continue
+			case symlinksError:
+				return &WalkError{file, errors.New("symbolic links are not allowed")}
+			}
+
+			real, err = filepath.EvalSymlinks(file)
+			if err != nil {
+				return &WalkError{file, err}
+			}
+			info, err = os.Stat(real)
+			if err != nil {
+				return &WalkError{file, err}
+			}
+			if info.IsDir() && slices.Contains(ancestors, real) {
+				return &WalkError{file, fmt.Errorf("symbolic link loops back to %s", real)}
+			}
+		}
+
+		if info.IsDir() {
+			if err := p.walkDir(ctx, file, fileRel, append(ancestors, real), fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fn(file, fileRel, info, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// symlinkRedirect returns the path relative to the source of the file a
+// symbolic link points to, when links are turned into redirects and the
+// linked file is part of the source.
+func (p *Plugin) symlinkRedirect(file string) (string, bool) {
+	if !p.SymlinkRedirects {
+		return "", false
+	}
+
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", false
+	}
+	if info, err := os.Stat(real); err != nil || info.IsDir() {
+		return "", false
+	}
+
+	source, err := filepath.EvalSymlinks(p.Source)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(source, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// symlinkSource creates a source with a file, a directory and links to both
+// next to a file outside of the source.
+func symlinkSource(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	source := filepath.Join(root, "src")
+	for _, dir := range []string{source, filepath.Join(source, "dir")} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "outside.txt"), filepath.Join(source, "index.html"), filepath.Join(source, "dir", "a.txt")} {
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink(t, "index.html", filepath.Join(source, "alias.html"))
+	symlink(t, "dir", filepath.Join(source, "dirlink"))
+	symlink(t, "../outside.txt", filepath.Join(source, "outside.txt"))
+	return source
+}
+
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symbolic links unsupported: %v", err)
+	}
+}
+
+// walk returns the files walked from the source, with the file they redirect
+// to for symbolic links turned into redirects.
+func walk(p *Plugin) ([]string, error) {
+	var files []string
+	err := p.walkSource(context.Background(), func(file, rel string, info os.FileInfo, link string) error {
+		if link != "" {
+			rel += " -> " + filepath.ToSlash(link)
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+func TestWalkSourceSymlinks(t *testing.T) {
+	source := symlinkSource(t)
+
+	tests := []struct {
+		policy    string
+		redirects bool
+		want      []string
+		err       bool
+	}{
+		{
+			policy: symlinksFollow,
+			want:   []string{"alias.html", "dir/a.txt", "dirlink/a.txt", "index.html", "outside.txt"},
+		},
+		{
+			policy: symlinksSkip,
+			want:   []string{"dir/a.txt", "index.html"},
+		},
+		{
+			policy: symlinksError,
+			err:    true,
+		},
+		{
+			policy:    symlinksSkip,
+			redirects: true,
+			want:      []string{"alias.html -> index.html", "dir/a.txt", "index.html"},
+		},
+		{
+			policy:    symlinksFollow,
+			redirects: true,
+			want:      []string{"alias.html -> index.html", "dir/a.txt", "dirlink/a.txt", "index.html", "outside.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		p := &Plugin{Source: source, Symlinks: tt.policy, SymlinkRedirects: tt.redirects}
+		got, err := walk(p)
+		if tt.err {
+			var walkErr *WalkError
+			if !errors.As(err, &walkErr) {
+				t.Errorf("%s: walkSource() error = %v, want a walk error", tt.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: walkSource() returned error %v", tt.policy, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s with redirects %v: walked %q, want %q", tt.policy, tt.redirects, got, tt.want)
+		}
+	}
+}
+
+func TestWalkSourceLoops(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, source string)
+	}{
+		{
+			name: "self loop",
+			setup: func(t *testing.T, source string) {
+				symlink(t, ".", filepath.Join(source, "a"))
+			},
+		},
+		{
+			name: "cycle between siblings",
+			setup: func(t *testing.T, source string) {
+				for _, dir := range []string{"a", "b"} {
+					if err := os.Mkdir(filepath.Join(source, dir), 0o755); err != nil {
+						t.Fatal(err)
+					}
+				}
+				symlink(t, "../b", filepath.Join(source, "a", "link"))
+				symlink(t, "../a", filepath.Join(source, "b", "link"))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := t.TempDir()
+			tt.setup(t, source)
+
+			_, err := walk(&Plugin{Source: source, Symlinks: symlinksFollow})
+			var walkErr *WalkError
+			if !errors.As(err, &walkErr) || !strings.Contains(err.Error(), "loops back") {
+				t.Errorf("walkSource() error = %v, want a loop error", err)
+			}
+		})
+	}
+}
+
+func TestSymlinkRedirect(t *testing.T) {
+	source := symlinkSource(t)
+
+	tests := []struct {
+		link      string
+		redirects bool
+		want      string
+		ok        bool
+	}{
+		{link: "alias.html", redirects: true, want: "index.html", ok: true},
+		{link: "alias.html", redirects: false},
+		{link: "dirlink", redirects: true},
+		{link: "outside.txt", redirects: true},
+	}
+
+	for _, tt := range tests {
+		p := &Plugin{Source: source, SymlinkRedirects: tt.redirects}
+		got, ok := p.symlinkRedirect(filepath.Join(source, tt.link))
+		if ok != tt.ok || filepath.ToSlash(got) != tt.want {
+			t.Errorf("symlinkRedirect(%q) with redirects %v = %q, %v, want %q, %v", tt.link, tt.redirects, got, ok, tt.want, tt.ok)
+		}
+	}
+}